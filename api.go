@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// The JSON API exposes the same aggregates as the HTML reports. Durations are
+// given in seconds.
+
+type apiReport struct {
+	ID    string            `json:"id"`
+	Index int               `json:"index"`
+	Name  string            `json:"name"`
+	Level string            `json:"level"`
+	Links map[string]string `json:"links"`
+}
+
+type apiGroupDuration struct {
+	Group   string  `json:"group"`
+	Seconds float64 `json:"seconds"`
+}
+
+type apiDurations struct {
+	Report     string             `json:"report"`
+	From       time.Time          `json:"from"`
+	To         time.Time          `json:"to"`
+	Percentile int                `json:"percentile,omitempty"`
+	Groups     []apiGroupDuration `json:"groups"`
+	Coverage   apiCoverage        `json:"coverage"`
+}
+
+type apiPoint struct {
+	Time    time.Time `json:"time"`
+	Seconds float64   `json:"seconds"`
+
+	// Build is omitted for rolling averages.
+	Build *apiBuildRef `json:"build,omitempty"`
+}
+
+type apiBuildRef struct {
+	Number int    `json:"number"`
+	WebURL string `json:"web_url"`
+	Commit string `json:"commit"`
+}
+
+type apiTimeseries struct {
+	Report   string      `json:"report"`
+	From     time.Time   `json:"from"`
+	To       time.Time   `json:"to"`
+	Group    string      `json:"group"`
+	Mode     string      `json:"mode"`
+	Points   []apiPoint  `json:"points"`
+	Coverage apiCoverage `json:"coverage"`
+}
+
+type apiGroupOutcomes struct {
+	Group       string  `json:"group"`
+	Builds      int     `json:"builds"`
+	PassRate    float64 `json:"pass_rate"`
+	FailureRate float64 `json:"failure_rate"`
+	CancelRate  float64 `json:"cancel_rate"`
+}
+
+type apiOutcomes struct {
+	Report   string             `json:"report"`
+	From     time.Time          `json:"from"`
+	To       time.Time          `json:"to"`
+	Groups   []apiGroupOutcomes `json:"groups"`
+	Coverage apiCoverage        `json:"coverage"`
+}
+
+type apiPeriod struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type apiGroupStats struct {
+	Count        int     `json:"count"`
+	TotalSeconds float64 `json:"total_seconds"`
+	P50Seconds   float64 `json:"p50_seconds"`
+	P90Seconds   float64 `json:"p90_seconds"`
+}
+
+// apiRelativeDelta holds deltas relative to the baseline. They are null if
+// the baseline is zero.
+type apiRelativeDelta struct {
+	Count *float64 `json:"count"`
+	Total *float64 `json:"total"`
+	P50   *float64 `json:"p50"`
+	P90   *float64 `json:"p90"`
+}
+
+type apiGroupComparison struct {
+	Group         string           `json:"group"`
+	Baseline      apiGroupStats    `json:"baseline"`
+	Current       apiGroupStats    `json:"current"`
+	Delta         apiGroupStats    `json:"delta"`
+	RelativeDelta apiRelativeDelta `json:"relative_delta"`
+	Regressed     bool             `json:"regressed"`
+	Improved      bool             `json:"improved"`
+}
+
+type apiComparison struct {
+	Report   string               `json:"report"`
+	Current  apiPeriod            `json:"current"`
+	Baseline apiPeriod            `json:"baseline"`
+	Groups   []apiGroupComparison `json:"groups"`
+	Coverage apiCoverage          `json:"coverage"`
+}
+
+// apiCoverage tells whether builds are missing from a response since they could
+// not be fetched from Buildkite.
+type apiCoverage struct {
+	Complete bool               `json:"complete"`
+	Missing  []apiMissingPeriod `json:"missing"`
+}
+
+type apiMissingPeriod struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+
+	// Reports are the ids of the available reports, given if the requested
+	// report doesn't exist.
+	Reports []string `json:"reports,omitempty"`
+}
+
+func (wr *Routes) apiRoutes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/reports", wr.apiReports)
+	r.Route("/reports/{query}", func(r chi.Router) {
+		r.Use(wr.redirectIndex)
+		r.Get("/totals", wr.apiTotals)
+		r.Get("/percentiles", wr.apiPercentiles)
+		r.Get("/outcomes", wr.apiOutcomes)
+		r.Get("/timeseries/{group}", wr.apiTimeseries)
+		r.Get("/compare", wr.apiCompare)
+	})
+
+	return r
+}
+
+func (wr *Routes) apiReports(w http.ResponseWriter, r *http.Request) {
+	queries := wr.Reports.Queries()
+	res := make([]apiReport, 0, len(queries))
+	for i, q := range queries {
+		level := "build"
+		links := map[string]string{
+			"html":        fmt.Sprintf("/%s/", q.ID),
+			"totals":      fmt.Sprintf("/api/v1/reports/%s/totals", q.ID),
+			"percentiles": fmt.Sprintf("/api/v1/reports/%s/percentiles", q.ID),
+			"compare":     fmt.Sprintf("/api/v1/reports/%s/compare", q.ID),
+		}
+		if q.JobLevel() {
+			level = "job"
+		} else {
+			links["outcomes"] = fmt.Sprintf("/api/v1/reports/%s/outcomes", q.ID)
+		}
+		res = append(res, apiReport{q.ID, i, q.Name, level, links})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (wr *Routes) apiTotals(w http.ResponseWriter, r *http.Request) {
+	query, err := wr.query(r)
+	if err != nil {
+		wr.apiReportNotFound(w)
+		return
+	}
+
+	period, err := wr.period(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	totals, coverage, err := totalsByGroup(r.Context(), wr.Buildkite, period.timePeriod, query)
+	if apiRespondFetchError(w, coverage, err) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiDurations{
+		Report:   query.Name,
+		From:     period.From,
+		To:       period.To,
+		Groups:   toAPIGroupDurations(totals),
+		Coverage: toAPICoverage(coverage),
+	})
+}
+
+func (wr *Routes) apiPercentiles(w http.ResponseWriter, r *http.Request) {
+	query, err := wr.query(r)
+	if err != nil {
+		wr.apiReportNotFound(w)
+		return
+	}
+
+	perc := 90
+	if p := r.URL.Query().Get("p"); p != "" {
+		perc, err = strconv.Atoi(p)
+		if err != nil || perc < 0 || perc > 100 {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "p must be an integer between 0 and 100"})
+			return
+		}
+	}
+
+	period, err := wr.period(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	percentiles, coverage, err := percentilesByGroup(r.Context(), wr.Buildkite, period.timePeriod, query, float64(perc)/100)
+	if apiRespondFetchError(w, coverage, err) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiDurations{
+		Report:     query.Name,
+		From:       period.From,
+		To:         period.To,
+		Percentile: perc,
+		Groups:     toAPIGroupDurations(percentiles),
+		Coverage:   toAPICoverage(coverage),
+	})
+}
+
+func (wr *Routes) apiOutcomes(w http.ResponseWriter, r *http.Request) {
+	query, err := wr.query(r)
+	if err != nil {
+		wr.apiReportNotFound(w)
+		return
+	}
+	if query.JobLevel() {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "outcomes are not available for job level reports"})
+		return
+	}
+
+	period, err := wr.period(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	outcomes, coverage, err := outcomesByGroup(r.Context(), wr.Buildkite, period.timePeriod, query)
+	if apiRespondFetchError(w, coverage, err) {
+		return
+	}
+
+	res := apiOutcomes{
+		Report:   query.Name,
+		From:     period.From,
+		To:       period.To,
+		Groups:   make([]apiGroupOutcomes, 0, len(outcomes)),
+		Coverage: toAPICoverage(coverage),
+	}
+	for _, o := range outcomes {
+		res.Groups = append(res.Groups, apiGroupOutcomes{o.Name, o.Builds, o.PassRate(), o.FailureRate(), o.CancelRate()})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (wr *Routes) apiTimeseries(w http.ResponseWriter, r *http.Request) {
+	query, err := wr.query(r)
+	if err != nil {
+		wr.apiReportNotFound(w)
+		return
+	}
+	group := urlParam(r, "group")
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "all"
+	}
+	if mode != "all" && mode != "rolling-average" {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "mode must be all or rolling-average"})
+		return
+	}
+
+	period, err := wr.period(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	items, coverage, err := groupTimeline(r.Context(), wr.Buildkite, period.timePeriod, query, group)
+	if apiRespondFetchError(w, coverage, err) {
+		return
+	}
+	if mode == "rolling-average" {
+		items = rollingAverage(items)
+	}
+
+	res := apiTimeseries{
+		Report:   query.Name,
+		From:     period.From,
+		To:       period.To,
+		Group:    group,
+		Mode:     mode,
+		Points:   make([]apiPoint, 0, len(items)),
+		Coverage: toAPICoverage(coverage),
+	}
+	for _, item := range items {
+		point := apiPoint{Time: item.When, Seconds: item.Duration.Seconds()}
+		if item.Build != (buildRef{}) {
+			point.Build = &apiBuildRef{item.Build.Number, item.Build.WebURL, item.Build.Commit}
+		}
+		res.Points = append(res.Points, point)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (wr *Routes) apiCompare(w http.ResponseWriter, r *http.Request) {
+	query, err := wr.query(r)
+	if err != nil {
+		wr.apiReportNotFound(w)
+		return
+	}
+
+	period, err := wr.period(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	baseline, err := wr.baselinePeriod(r, period)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+
+	comparisons, coverage, err := compareGroups(r.Context(), wr.Buildkite, baseline.timePeriod, period.timePeriod, query)
+	if apiRespondFetchError(w, coverage, err) {
+		return
+	}
+
+	res := apiComparison{
+		Report:   query.Name,
+		Current:  apiPeriod{period.From, period.To},
+		Baseline: apiPeriod{baseline.From, baseline.To},
+		Groups:   make([]apiGroupComparison, 0, len(comparisons)),
+		Coverage: toAPICoverage(coverage),
+	}
+	for _, c := range comparisons {
+		before, after := toAPIGroupStats(c.Baseline), toAPIGroupStats(c.Current)
+		res.Groups = append(res.Groups, apiGroupComparison{
+			Group:    c.Name,
+			Baseline: before,
+			Current:  after,
+			Delta: apiGroupStats{
+				Count:        after.Count - before.Count,
+				TotalSeconds: after.TotalSeconds - before.TotalSeconds,
+				P50Seconds:   after.P50Seconds - before.P50Seconds,
+				P90Seconds:   after.P90Seconds - before.P90Seconds,
+			},
+			RelativeDelta: apiRelativeDelta{
+				Count: apiRelative(float64(before.Count), float64(after.Count)),
+				Total: apiRelative(before.TotalSeconds, after.TotalSeconds),
+				P50:   apiRelative(before.P50Seconds, after.P50Seconds),
+				P90:   apiRelative(before.P90Seconds, after.P90Seconds),
+			},
+			Regressed: c.Regressed(),
+			Improved:  c.Improved(),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (wr *Routes) apiReportNotFound(w http.ResponseWriter) {
+	res := apiError{Error: "report not found"}
+	for _, q := range wr.Reports.Queries() {
+		res.Reports = append(res.Reports, q.ID)
+	}
+	writeJSON(w, http.StatusNotFound, res)
+}
+
+func toAPIGroupDurations(durations namedDurationSlice) []apiGroupDuration {
+	res := make([]apiGroupDuration, 0, len(durations))
+	for _, d := range durations {
+		res = append(res, apiGroupDuration{d.Name, d.Duration.Seconds()})
+	}
+	return res
+}
+
+func toAPIGroupStats(s groupStats) apiGroupStats {
+	return apiGroupStats{s.Count, s.Total.Seconds(), s.P50.Seconds(), s.P90.Seconds()}
+}
+
+func apiRelative(before, after float64) *float64 {
+	delta, ok := relativeDelta(before, after)
+	if !ok {
+		return nil
+	}
+	return &delta
+}
+
+func toAPICoverage(c Coverage) apiCoverage {
+	res := apiCoverage{
+		Complete: c.Complete(),
+		Missing:  make([]apiMissingPeriod, 0),
+	}
+	for _, p := range c.Missing() {
+		res.Missing = append(res.Missing, apiMissingPeriod{p.From, p.To})
+	}
+	return res
+}
+
+// apiRespondFetchError is the JSON equivalent of respondFetchError.
+func apiRespondFetchError(w http.ResponseWriter, c Coverage, err error) bool {
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: fmt.Sprintf("unable to fetch builds: %s", err)})
+		return true
+	}
+	if c.Empty() {
+		writeJSON(w, http.StatusBadGateway, apiError{Error: fmt.Sprintf("unable to fetch builds: %s", c.Failed[0])})
+		return true
+	}
+	setCoverageHeader(w, c)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("unable to write JSON response:", err)
+	}
+}
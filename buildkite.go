@@ -3,57 +3,274 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/buildkite/go-buildkite/buildkite"
-	"golang.org/x/sync/errgroup"
+	"github.com/google/go-querystring/query"
+	"golang.org/x/sync/singleflight"
 )
 
 type Build struct {
-	ID          string
+	ID string
+
+	// Org is the slug of the Buildkite organization the build belongs to.
+	Org string
+
 	Pipeline    Pipeline
 	Branch      string
+	State       string
 	ScheduledAt time.Time
 	FinishedAt  time.Time
 	StartedAt   time.Time
 	CreatedAt   time.Time
+	Jobs        []Job
+
+	// Number is the number of the build within its pipeline.
+	Number  int
+	WebURL  string
+	Commit  string
+	Message string
+
+	// Source is what triggered the build: webhook, ui, api, schedule or
+	// trigger_job.
+	Source string
+
+	// Creator is the Buildkite user who created the build. Empty for builds
+	// created by webhooks or schedules.
+	Creator Person
+
+	// Author is the author of the commit as told by the source of the build.
+	Author Person
+
+	// PullRequest is nil for builds that are not building a pull request.
+	PullRequest *PullRequest
+
+	// MetaData is the meta-data set using buildkite-agent meta-data.
+	MetaData map[string]string
 }
 
 type Pipeline struct {
 	Name string
 }
 
+type Person struct {
+	Name  string
+	Email string
+}
+
+type PullRequest struct {
+	ID         string
+	Base       string
+	Repository string
+}
+
+// Job is a command step executed by an agent as part of a build.
+type Job struct {
+	StepKey string
+	Label   string
+	Queue   string
+	State   string
+
+	// AgentID and AgentName identify the agent that ran the job. Empty for
+	// jobs that never were assigned an agent.
+	AgentID   string
+	AgentName string
+
+	// ExitStatus is nil for jobs that never finished running.
+	ExitStatus *int
+
+	CreatedAt   time.Time
+	ScheduledAt time.Time
+	RunnableAt  time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time
+}
+
+// Step identifies the pipeline step a job was created from. Prefers the step
+// key since labels commonly contain emojis and get renamed.
+func (j Job) Step() string {
+	if j.StepKey != "" {
+		return j.StepKey
+	}
+	return j.Label
+}
+
+// Duration returns how long the job was running. The second return value is
+// false for jobs that never ran.
+func (j Job) Duration() (time.Duration, bool) {
+	if j.StartedAt.IsZero() || j.FinishedAt.IsZero() {
+		return 0, false
+	}
+	return j.FinishedAt.Sub(j.StartedAt), true
+}
+
+// apiBuild extends the Build of the go-buildkite client with fields that it
+// does not (yet) know about.
+type apiBuild struct {
+	buildkite.Build
+	Jobs        []apiJob        `json:"jobs,omitempty"`
+	Source      *string         `json:"source,omitempty"`
+	Author      *apiAuthor      `json:"author,omitempty"`
+	PullRequest *apiPullRequest `json:"pull_request,omitempty"`
+}
+
+type apiAuthor struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+type apiPullRequest struct {
+	ID         string `json:"id"`
+	Base       string `json:"base"`
+	Repository string `json:"repository"`
+}
+
+type apiJob struct {
+	buildkite.Job
+	StepKey    *string              `json:"step_key,omitempty"`
+	RunnableAt *buildkite.Timestamp `json:"runnable_at,omitempty"`
+}
+
 // Mapping to an internal struct will use a lot less memory.
-func newBuildFromBuildkite(b buildkite.Build) Build {
+func newBuildFromBuildkite(b apiBuild) Build {
 	res := Build{
 		ID: *b.ID,
 		Pipeline: Pipeline{
 			Name: *b.Pipeline.Name,
 		},
 		Branch: *b.Branch,
+		State:  *b.State,
+
+		// Builds that never ran (for example canceled before being picked
+		// up by an agent) lack some of the timestamps. They are left as zero
+		// values.
+		CreatedAt:   timestampOrZero(b.CreatedAt),
+		StartedAt:   timestampOrZero(b.StartedAt),
+		ScheduledAt: timestampOrZero(b.ScheduledAt),
+		FinishedAt:  timestampOrZero(b.FinishedAt),
+
+		WebURL:   optionalString(b.WebURL),
+		Commit:   optionalString(b.Commit),
+		Message:  optionalString(b.Message),
+		Source:   optionalString(b.Source),
+		MetaData: metaData(b.MetaData),
+	}
+	if b.Number != nil {
+		res.Number = *b.Number
+	}
+	if b.Creator != nil {
+		res.Creator = Person{b.Creator.Name, b.Creator.Email}
+	}
+	if b.Author != nil {
+		res.Author = Person{b.Author.Name, b.Author.Email}
+	}
+	if b.PullRequest != nil {
+		res.PullRequest = &PullRequest{b.PullRequest.ID, b.PullRequest.Base, b.PullRequest.Repository}
+	}
+	for _, j := range b.Jobs {
+		// Waiters, block steps and triggers are not executed by agents and
+		// are of no interest when it comes to timing.
+		if j.Type == nil || *j.Type != "script" {
+			continue
+		}
+		res.Jobs = append(res.Jobs, newJobFromBuildkite(j))
+	}
+	return res
+}
+
+func newJobFromBuildkite(j apiJob) Job {
+	return Job{
+		StepKey:    optionalString(j.StepKey),
+		Label:      optionalString(j.Name),
+		Queue:      agentQueue(j.AgentQueryRules),
+		State:      optionalString(j.State),
+		AgentID:    optionalString(j.Agent.ID),
+		AgentName:  optionalString(j.Agent.Name),
+		ExitStatus: j.ExitStatus,
+
+		CreatedAt:   timestampOrZero(j.CreatedAt),
+		ScheduledAt: timestampOrZero(j.ScheduledAt),
+		RunnableAt:  timestampOrZero(j.RunnableAt),
+		StartedAt:   timestampOrZero(j.StartedAt),
+		FinishedAt:  timestampOrZero(j.FinishedAt),
+	}
+}
+
+// agentQueue extracts the queue from agent query rules such as
+// ["queue=deploy", "os=linux"].
+func agentQueue(rules []string) string {
+	for _, rule := range rules {
+		if strings.HasPrefix(rule, "queue=") {
+			return strings.TrimPrefix(rule, "queue=")
+		}
+	}
+	// Jobs without a queue rule are run on the default queue.
+	return "default"
+}
 
-		// We can safely assumed that all timestamps are set in the input, as
-		// we have a requirement that all builds should be finished when
-		// querying from Buildkite.
-		CreatedAt:   b.CreatedAt.Time,
-		StartedAt:   b.StartedAt.Time,
-		ScheduledAt: b.ScheduledAt.Time,
-		FinishedAt:  b.FinishedAt.Time,
+// metaData converts build meta-data, which the client leaves undecoded, to
+// strings. Meta-data values are always strings in practice.
+func metaData(v interface{}) map[string]string {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(m))
+	for k, e := range m {
+		if s, ok := e.(string); ok {
+			res[k] = s
+		} else {
+			res[k] = fmt.Sprint(e)
+		}
 	}
 	return res
 }
 
+func optionalString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func timestampOrZero(t *buildkite.Timestamp) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+// finishedStates are the terminal build states. We only fetch builds in these
+// states since builds that are still running will change.
+var finishedStates = []string{"passed", "failed", "canceled", "blocked", "skipped", "not_run"}
+
+func isFinishedState(s string) bool {
+	for _, state := range finishedStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
 type Buildkite interface {
-	// TODO: Avoid returning a list of builds and instead take a callback
-	// (which calls back serially). That way, we don't need to read up all
-	// builds into memory, but can reduce the results quickly instead.
-	ListBuilds(from time.Time, p BuildPredicate) ([]Build, error)
+	// ForEachBuild calls f serially for every build created between from and
+	// to that matches p. That way, we don't need to read up all builds into memory,
+	// but can reduce the results quickly instead. Iteration stops at the first
+	// error returned by f or when ctx is done.
+	//
+	// Intervals that fail to be fetched are skipped and reported in the
+	// returned Coverage instead of failing the whole iteration.
+	ForEachBuild(ctx context.Context, from, to time.Time, p BuildPredicate, f func(Build) error) (Coverage, error)
 
 	RefreshCache(from time.Time) error
 }
@@ -62,11 +279,25 @@ type BuildPredicate interface {
 	Predicate(Build) bool
 }
 
+// BuildPredicateFunc allows using an ordinary function as a BuildPredicate.
+type BuildPredicateFunc func(Build) bool
+
+func (f BuildPredicateFunc) Predicate(b Build) bool {
+	return f(b)
+}
+
+// NetworkBuildkite fetches the builds of a single organization. Several of
+// them can share a Cache since cache keys are namespaced by organization.
 type NetworkBuildkite struct {
 	Client *buildkite.Client
 	Org    string
 	Cache  Cache
-	mutex  sync.Mutex
+
+	// inflight deduplicates concurrent fetches of the same interval.
+	inflight singleflight.Group
+
+	// Local is an optional in-process cache in front of Cache.
+	Local *BuildLRU
 }
 
 type Cache interface {
@@ -79,7 +310,9 @@ func (b *NetworkBuildkite) RefreshCache(from time.Time) error {
 
 	intervals := generateIntervals(from, to, intervalLength)
 	for _, interval := range intervals {
-		if _, err := b.listBuildsBetween(interval, time.Duration(0), true); err != nil {
+		// Cached as long as older intervals since the refresh command is
+		// expected to rewrite recent intervals before they change.
+		if _, err := b.listBuildsBetween(context.Background(), interval, staticCacheTTL(interval.From), true); err != nil {
 			return err
 		}
 	}
@@ -89,59 +322,99 @@ func (b *NetworkBuildkite) RefreshCache(from time.Time) error {
 const itemsPerPage = 100
 const intervalLength = time.Hour
 
-func (b *NetworkBuildkite) ListBuilds(from time.Time, pred BuildPredicate) ([]Build, error) {
-	// We are using a mutex here to avoid concurrent ListBuilds calls
-	// populating the cache at the same time. Better to have all wait for one
-	// process to populate the cache. Will be faster and will not incur cost on
-	// the Buildkite rate limit.
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+// fetchConcurrency limits the number of intervals being fetched, and held in
+// memory, at the same time.
+const fetchConcurrency = 30
 
-	to := time.Now()
+type intervalResult struct {
+	builds []Build
+	err    error
+}
 
-	var eg errgroup.Group
+func (b *NetworkBuildkite) ForEachBuild(ctx context.Context, from, to time.Time, pred BuildPredicate, f func(Build) error) (Coverage, error) {
+	defer scrapeLatency.ObserveSince(time.Now())
 
-	concurrency := 30
-	sem := make(chan struct{}, concurrency)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	intervals := generateIntervals(from, to, intervalLength)
-	parallelResults := make([][]Build, len(intervals))
-	for i, interval := range intervals {
-
-		// See https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
-		index := i
-		loopinterval := interval
+	coverage := newCoverage(b.Org, intervals)
+	results := make([]chan intervalResult, len(intervals))
+	for i := range results {
+		// Buffered to never block a fetcher if we stopped consuming early.
+		results[i] = make(chan intervalResult, 1)
+	}
 
-		eg.Go(func() error {
-			// Limit concurrency to be nice to Buildkite.
-			sem <- struct{}{}
-			defer func() { <-sem }()
+	// Limit concurrency to be nice to Buildkite. A slot is released only
+	// when its interval has been consumed below, so this also bounds how
+	// many intervals are kept in memory.
+	sem := make(chan struct{}, fetchConcurrency)
+	go func() {
+		for i, interval := range intervals {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
 
-			b, err := b.listBuildsBetween(loopinterval, cacheTTL(from), false)
-			parallelResults[index] = b
-			return err
-		})
-	}
+			go func(res chan<- intervalResult, interval timeInterval) {
+				builds, err := b.listBuildsBetween(ctx, interval, cacheTTL(interval), false)
+				res <- intervalResult{builds, err}
+			}(results[i], interval)
+		}
+	}()
+
+	for i, res := range results {
+		var r intervalResult
+		select {
+		case r = <-res:
+		case <-ctx.Done():
+			return coverage, ctx.Err()
+		}
+		<-sem
 
-	err := eg.Wait()
-	log.Println("error:", err)
+		if r.err != nil {
+			coverage.Failed = append(coverage.Failed, FailedInterval{intervals[i], b.Org, r.err})
+			continue
+		}
 
-	var res []Build
-	for _, bs := range parallelResults {
-		for _, b := range bs {
-			if b.CreatedAt.After(from) && b.CreatedAt.Before(to) && pred.Predicate(b) {
-				// Note that the daily intervals will be a superset of [to,
-				// from). This is to get the cached buckets static. This means
-				// that we need to do some filtering here.
-				res = append(res, b)
+		for _, build := range r.builds {
+			// Note that the hourly intervals will be a superset of [to,
+			// from). This is to get the cached buckets static. This means
+			// that we need to do some filtering here.
+			if build.CreatedAt.After(from) && build.CreatedAt.Before(to) && pred.Predicate(build) {
+				if err := f(build); err != nil {
+					return coverage, err
+				}
 			}
 		}
 	}
 
-	return res, err
+	if !coverage.Complete() {
+		first := coverage.Failed[0]
+		log.Printf("unable to fetch builds of %d out of %d intervals. First failure, for builds created %s: %s", len(coverage.Failed), coverage.Intervals, first.From.Format(time.RFC3339), first)
+	}
+	return coverage, nil
 }
 
-func cacheTTL(from time.Time) time.Duration {
+// recentInterval is for how long after an interval has ended builds created
+// during it are expected to still finish, and be added to it.
+const recentInterval = 3 * time.Hour
+
+// recentIntervalTTL is for how long recent intervals are cached when fetched
+// on demand. Short, since builds finishing after an interval was fetched would
+// otherwise be missing until it expires.
+const recentIntervalTTL = 5 * time.Minute
+
+func cacheTTL(interval timeInterval) time.Duration {
+	if time.Since(interval.To) < recentInterval {
+		return recentIntervalTTL
+	}
+	return staticCacheTTL(interval.From)
+}
+
+// staticCacheTTL is the TTL of intervals that aren't expected to change.
+func staticCacheTTL(from time.Time) time.Duration {
 	// Cache aggresively for older builds. We don't expect them to be modified.
 	// Use spread to not have to reload all builds at the same time.
 	spread := time.Duration(rand.Intn(20*24*60)) * time.Minute
@@ -168,15 +441,89 @@ func generateIntervals(from, to time.Time, chunks time.Duration) []timeInterval
 	return res
 }
 
-func (b *NetworkBuildkite) listBuildsBetween(interval timeInterval, cacheTTL time.Duration, forceInvalidation bool) ([]Build, error) {
-	cacheKey := fmt.Sprintf("%d-%d", interval.From.Unix(), interval.To.Unix())
+// buildSchemaVersion must be bumped whenever the JSON encoding of Build or Job
+// changes, since entries cached by other versions are never read.
+const buildSchemaVersion = 1
+
+// cacheKey returns the key of the builds of an interval. Besides the interval,
+// it contains everything that affects what is cached: the organization, the
+// schema version and the states fetched. That way, a cache can be shared
+// between organizations and versions of this program.
+func (b *NetworkBuildkite) cacheKey(interval timeInterval) string {
+	return fmt.Sprintf("builds/v%d/%s/%s/%d-%d", buildSchemaVersion, b.Org, strings.Join(finishedStates, ","), interval.From.Unix(), interval.To.Unix())
+}
+
+func (b *NetworkBuildkite) listBuildsBetween(ctx context.Context, interval timeInterval, cacheTTL time.Duration, forceInvalidation bool) ([]Build, error) {
+	cacheKey := b.cacheKey(interval)
 	if !forceInvalidation {
+		if b.Local != nil {
+			if cached, ok := b.Local.Get(cacheKey); ok {
+				return cached, nil
+			}
+		}
+
 		cached, err := b.readFromCache(cacheKey)
-		if err == nil {
+		switch {
+		case err == nil:
+			cacheRequests.Inc("hit")
+			if b.Local != nil {
+				b.Local.Put(cacheKey, cached, cacheTTL)
+			}
 			return cached, err
+		case isUndecodable(err):
+			// Treated like a miss. The entry is overwritten by the refetch.
+			log.Printf("ignoring cache entry %s: %s", cacheKey, err)
+			cacheRequests.Inc("undecodable")
+		default:
+			cacheRequests.Inc("miss")
+		}
+	}
+
+	// Avoid concurrent requests populating the cache for the same interval at
+	// the same time. Better to have all wait for one of them. Will be faster
+	// and will not incur cost on the Buildkite rate limit. Forced refreshes
+	// must not share a fetch that might have been served from cache.
+	flightKey := cacheKey
+	if forceInvalidation {
+		flightKey = "refresh-" + cacheKey
+	}
+	result, err, _ := b.inflight.Do(flightKey, func() (interface{}, error) {
+		if !forceInvalidation {
+			// A flight that finished while we were reading from the cache
+			// might have stored the interval already. Not counted since the
+			// miss above already was.
+			if b.Local != nil {
+				if cached, ok := b.Local.lookup(cacheKey); ok {
+					return cached, nil
+				}
+			}
+			if cached, err := b.readFromCache(cacheKey); err == nil {
+				if b.Local != nil {
+					b.Local.Put(cacheKey, cached, cacheTTL)
+				}
+				return cached, nil
+			}
+		}
+		return b.fetchBuildsBetween(ctx, interval, cacheKey, cacheTTL)
+	})
+	if err != nil {
+		if isContextError(err) && ctx.Err() == nil {
+			// We shared the fetch of a caller that went away. Our request
+			// is still wanted, so fetch again.
+			return b.listBuildsBetween(ctx, interval, cacheTTL, forceInvalidation)
 		}
+		return nil, err
 	}
+	return result.([]Build), nil
+}
 
+// isContextError tells whether err is caused by a canceled or timed out
+// context.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (b *NetworkBuildkite) fetchBuildsBetween(ctx context.Context, interval timeInterval, cacheKey string, cacheTTL time.Duration) ([]Build, error) {
 	opts := &buildkite.BuildsListOptions{
 		ListOptions: buildkite.ListOptions{
 			Page:    1,
@@ -185,13 +532,15 @@ func (b *NetworkBuildkite) listBuildsBetween(interval timeInterval, cacheTTL tim
 		CreatedFrom: interval.From,
 		CreatedTo:   interval.To,
 
-		// This implies that all `Build`s will have FinishedAt set.
-		State: []string{"passed"},
+		// Builds in a terminal state never change, which is what allows us to
+		// cache them. Note that this does _not_ imply that all timestamps are
+		// set.
+		State: finishedStates,
 	}
 
 	var result []Build
 	for {
-		builds, resp, err := b.query(b.Org, opts)
+		builds, resp, err := b.query(ctx, b.Org, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -205,28 +554,81 @@ func (b *NetworkBuildkite) listBuildsBetween(interval timeInterval, cacheTTL tim
 	}
 
 	_ = b.populateCache(cacheKey, result, cacheTTL)
+	if b.Local != nil {
+		b.Local.Put(cacheKey, result, cacheTTL)
+	}
 
 	return result, nil
 }
 
-func (b *NetworkBuildkite) query(org string, opts *buildkite.BuildsListOptions) ([]Build, *buildkite.Response, error) {
-	bbuilds, resp, err := b.Client.Builds.ListByOrg(org, opts)
+func (b *NetworkBuildkite) query(ctx context.Context, org string, opts *buildkite.BuildsListOptions) ([]Build, *buildkite.Response, error) {
+	// Not using Client.Builds.ListByOrg since we need fields that its Build
+	// does not have.
+	qs, err := query.Values(opts)
 	if err != nil {
+		return nil, nil, err
+	}
+	req, err := b.Client.NewRequest("GET", fmt.Sprintf("v2/organizations/%s/builds?%s", org, qs.Encode()), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+
+	var bbuilds []apiBuild
+	resp, err := b.Client.Do(req, &bbuilds)
+	if err != nil {
+		apiRequests.Inc("error")
 		return nil, resp, err
 	}
+	apiRequests.Inc("success")
 
 	var result []Build
 	for _, b := range bbuilds {
-		result = append(result, newBuildFromBuildkite(b))
+		build := newBuildFromBuildkite(b)
+		build.Org = org
+		result = append(result, build)
 	}
 
 	return result, resp, err
 }
 
+// MultiOrgBuildkite iterates over the builds of several organizations, one
+// organization at a time.
+type MultiOrgBuildkite []*NetworkBuildkite
+
+func (m MultiOrgBuildkite) ForEachBuild(ctx context.Context, from, to time.Time, p BuildPredicate, f func(Build) error) (Coverage, error) {
+	var coverage Coverage
+	for _, bk := range m {
+		c, err := bk.ForEachBuild(ctx, from, to, p, f)
+		// Merging tells the intervals of each organization apart, so the
+		// coverage is only empty if every organization failed.
+		coverage = coverage.Merge(c)
+		if err != nil {
+			return coverage, err
+		}
+	}
+	return coverage, nil
+}
+
+// RefreshCache refreshes every organization, also after others failed, and
+// returns the errors of all that did.
+func (m MultiOrgBuildkite) RefreshCache(from time.Time) error {
+	var failures []string
+	for _, bk := range m {
+		if err := bk.RefreshCache(from); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", bk.Org, err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
 func (b *NetworkBuildkite) populateCache(key string, builds []Build, ttl time.Duration) error {
 	s, err := json.Marshal(builds)
 	if err != nil {
-		log.Panicln(err)
+		return err
 	}
 
 	// Compressing to make this a bit more future proof in case we have a _lot_
@@ -238,6 +640,21 @@ func (b *NetworkBuildkite) populateCache(key string, builds []Build, ttl time.Du
 	return b.Cache.Put(key, s, ttl)
 }
 
+// undecodableError is returned by readFromCache for entries that exist but
+// can't be decoded, for example if written by a broken version of this program.
+type undecodableError struct {
+	err error
+}
+
+func (e undecodableError) Error() string {
+	return "undecodable: " + e.err.Error()
+}
+
+func isUndecodable(err error) bool {
+	_, ok := err.(undecodableError)
+	return ok
+}
+
 func (b *NetworkBuildkite) readFromCache(key string) ([]Build, error) {
 	var res []Build
 	s, err := b.Cache.Get(key)
@@ -245,11 +662,13 @@ func (b *NetworkBuildkite) readFromCache(key string) ([]Build, error) {
 		return res, err
 	}
 
-	s = decompress(s)
-
-	err = json.Unmarshal(s, &res)
+	s, err = decompress(s)
 	if err != nil {
-		log.Panicln(err)
+		return nil, undecodableError{err}
+	}
+
+	if err := json.Unmarshal(s, &res); err != nil {
+		return nil, undecodableError{err}
 	}
 
 	return res, nil
@@ -264,21 +683,18 @@ func compress(b []byte) []byte {
 	return output.Bytes()
 }
 
-func decompress(b []byte) []byte {
+func decompress(b []byte) ([]byte, error) {
 	input := bytes.NewBuffer(b)
 	output := bytes.NewBuffer(nil)
-	var err error
 	r, err := gzip.NewReader(input)
 	if err != nil {
-		log.Panicln("unable to create gzip reader:", err)
+		return nil, fmt.Errorf("unable to create gzip reader: %s", err)
 	}
-	_, err = io.Copy(output, r)
-	if err != nil {
-		log.Panicln("unable to decompress:", err)
+	if _, err := io.Copy(output, r); err != nil {
+		return nil, fmt.Errorf("unable to decompress: %s", err)
 	}
-	err = r.Close()
-	if err != nil {
-		log.Panicln("unable to Close when decompressing:", err)
+	if err := r.Close(); err != nil {
+		return nil, fmt.Errorf("unable to Close when decompressing: %s", err)
 	}
-	return output.Bytes()
+	return output.Bytes(), nil
 }
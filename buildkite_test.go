@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// newTestBuildkite returns a NetworkBuildkite of org fetching builds from
+// handler and caching them in a disk cache of its own.
+func newTestBuildkite(t *testing.T, org string, handler http.HandlerFunc) *NetworkBuildkite {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := openTestDiskCache(t, filepath.Join(t.TempDir(), "cache"))
+	t.Cleanup(func() { cache.Close() })
+	client := buildkite.NewClient(http.DefaultClient)
+	client.BaseURL = baseURL
+	return &NetworkBuildkite{Client: client, Org: org, Cache: cache}
+}
+
+func TestMultiOrgBuildkiteRefreshesEveryOrganization(t *testing.T) {
+	var mutex sync.Mutex
+	requests := make(map[string]int)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		// /v2/organizations/<org>/builds
+		org := strings.Split(r.URL.Path, "/")[3]
+		mutex.Lock()
+		requests[org]++
+		mutex.Unlock()
+		if strings.HasPrefix(org, "broken") {
+			http.Error(w, `{"message": "Forbidden"}`, http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("[]"))
+	}
+	var bk MultiOrgBuildkite
+	for _, org := range []string{"broken-first", "working", "broken-last"} {
+		bk = append(bk, newTestBuildkite(t, org, handler))
+	}
+
+	err := bk.RefreshCache(time.Now().Add(-30 * time.Minute))
+	if err == nil {
+		t.Fatal("expected the failures to be returned")
+	}
+	for _, org := range []string{"broken-first", "broken-last"} {
+		if !strings.Contains(err.Error(), org+": ") {
+			t.Errorf("error %q does not mention %s", err, org)
+		}
+	}
+	if strings.Contains(err.Error(), "working") {
+		t.Errorf("error %q mentions an organization which did not fail", err)
+	}
+	for _, org := range []string{"broken-first", "working", "broken-last"} {
+		if requests[org] == 0 {
+			t.Errorf("%s was not refreshed", org)
+		}
+	}
+}
+
+func TestNetworkBuildkiteAbortsRequestsWhenCanceled(t *testing.T) {
+	started := make(chan struct{}, 100)
+	aborted := make(chan struct{}, 100)
+	bk := newTestBuildkite(t, "org", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(5 * time.Second):
+			w.Write([]byte("[]"))
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	allBuilds := BuildPredicateFunc(func(Build) bool { return true })
+	_, err := bk.ForEachBuild(ctx, time.Now().Add(-30*time.Minute), time.Now(), allBuilds, func(Build) error { return nil })
+	if err != context.Canceled {
+		t.Fatalf("ForEachBuild() = %v, want %v", err, context.Canceled)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(3 * time.Second):
+		t.Error("the request was not aborted")
+	}
+}
+
+// missingOnce misses the first lookup of every key, as if the entry was
+// stored by a concurrent fetch right after.
+type missingOnce struct {
+	Cache
+	looked map[string]bool
+}
+
+func (c *missingOnce) Get(k string) ([]byte, error) {
+	if !c.looked[k] {
+		c.looked[k] = true
+		return nil, errCacheMiss
+	}
+	return c.Cache.Get(k)
+}
+
+func TestNetworkBuildkiteRereadsCacheBeforeFetching(t *testing.T) {
+	bk := newTestBuildkite(t, "org", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL)
+		w.Write([]byte("[]"))
+	})
+	bk.Cache = &missingOnce{bk.Cache, make(map[string]bool)}
+
+	interval := timeInterval{time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC), time.Date(2019, 3, 1, 11, 0, 0, 0, time.UTC)}
+	want := []Build{{ID: "cached", Org: "org", CreatedAt: interval.From.Add(time.Minute)}}
+	if err := bk.populateCache(bk.cacheKey(interval), want, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := bk.listBuildsBetween(context.Background(), interval, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != "cached" {
+		t.Errorf("listBuildsBetween() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Now()
+	current := timeInterval{now.Truncate(time.Hour), now.Truncate(time.Hour).Add(time.Hour)}
+	if got := cacheTTL(current); got != recentIntervalTTL {
+		t.Errorf("cacheTTL() of the current hour = %s, want %s", got, recentIntervalTTL)
+	}
+
+	recent := timeInterval{now.Add(-2 * time.Hour), now.Add(-time.Hour)}
+	if got := cacheTTL(recent); got != recentIntervalTTL {
+		t.Errorf("cacheTTL() of an hour ago = %s, want %s", got, recentIntervalTTL)
+	}
+
+	old := timeInterval{now.Add(-48 * time.Hour), now.Add(-47 * time.Hour)}
+	if got := cacheTTL(old); got < 72*time.Hour {
+		t.Errorf("cacheTTL() of two days ago = %s, want at least 72h", got)
+	}
+}
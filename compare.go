@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// regressionThreshold is the relative increase of the 50th or 90th percentile
+// of a group for it to be considered a regression. Decreases of the same size
+// are considered improvements.
+const regressionThreshold = 0.1
+
+// groupStats summarizes the durations of a group during a period.
+type groupStats struct {
+	Count int
+	Total time.Duration
+	P50   time.Duration
+	P90   time.Duration
+}
+
+func newGroupStats(durations []time.Duration) groupStats {
+	if len(durations) == 0 {
+		return groupStats{}
+	}
+	res := groupStats{
+		Count: len(durations),
+		P50:   durationPercentile(durations, 0.5),
+		P90:   durationPercentile(durations, 0.9),
+	}
+	for _, d := range durations {
+		res.Total += d
+	}
+	return res
+}
+
+// groupComparison compares a group during a baseline period to a current
+// period.
+type groupComparison struct {
+	Name     string
+	Baseline groupStats
+	Current  groupStats
+}
+
+// Regressed returns whether the 50th or 90th percentile got worse by more
+// than regressionThreshold.
+func (c groupComparison) Regressed() bool {
+	return worsened(c.Baseline.P50, c.Current.P50) || worsened(c.Baseline.P90, c.Current.P90)
+}
+
+// Improved returns whether the 50th or 90th percentile got better by more
+// than regressionThreshold without the other one regressing.
+func (c groupComparison) Improved() bool {
+	if c.Regressed() {
+		return false
+	}
+	return improved(c.Baseline.P50, c.Current.P50) || improved(c.Baseline.P90, c.Current.P90)
+}
+
+// relativeDelta returns the change from before to after relative to before.
+// ok is false if there was nothing before to relate to.
+func relativeDelta(before, after float64) (delta float64, ok bool) {
+	if before == 0 {
+		return 0, false
+	}
+	return (after - before) / before, true
+}
+
+func worsened(before, after time.Duration) bool {
+	delta, ok := relativeDelta(float64(before), float64(after))
+	return ok && delta > regressionThreshold
+}
+
+func improved(before, after time.Duration) bool {
+	delta, ok := relativeDelta(float64(before), float64(after))
+	return ok && after != 0 && delta < -regressionThreshold
+}
+
+// compareGroups compares the durations of every group during baseline to
+// current, the groups that took the most time during current first. Groups
+// only seen during one of the periods are included with zero stats for the
+// other.
+func compareGroups(ctx context.Context, bk Buildkite, baseline, current timePeriod, q Query) ([]groupComparison, Coverage, error) {
+	before, baselineCoverage, err := durationsByGroup(ctx, bk, baseline, q)
+	if err != nil {
+		return nil, baselineCoverage, err
+	}
+	// Comparing against nothing is meaningless.
+	if baselineCoverage.Empty() {
+		return nil, baselineCoverage, nil
+	}
+	after, currentCoverage, err := durationsByGroup(ctx, bk, current, q)
+	if err != nil || currentCoverage.Empty() {
+		return nil, currentCoverage, err
+	}
+
+	comparisons := make(map[string]*groupComparison)
+	get := func(name string) *groupComparison {
+		c, ok := comparisons[name]
+		if !ok {
+			c = &groupComparison{Name: name}
+			comparisons[name] = c
+		}
+		return c
+	}
+	for name, durations := range before {
+		get(name).Baseline = newGroupStats(durations)
+	}
+	for name, durations := range after {
+		get(name).Current = newGroupStats(durations)
+	}
+
+	res := make([]groupComparison, 0, len(comparisons))
+	for _, c := range comparisons {
+		res = append(res, *c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Current.Total != res[j].Current.Total {
+			return res[i].Current.Total > res[j].Current.Total
+		}
+		return res[i].Name < res[j].Name
+	})
+
+	// The periods can share intervals since intervals start at midnight, so
+	// the current period fetches the last day of an adjacent baseline again.
+	// Merging counts those only once.
+	return res, baselineCoverage.Merge(currentCoverage), nil
+}
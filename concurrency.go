@@ -0,0 +1,243 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// timePeriod is a half-open interval of time, [From, To).
+type timePeriod struct {
+	From time.Time
+	To   time.Time
+}
+
+func (p timePeriod) Duration() time.Duration {
+	return p.To.Sub(p.From)
+}
+
+// concurrencyStep is the number of jobs running from When until the next
+// step.
+type concurrencyStep struct {
+	When    time.Time
+	Running int
+}
+
+type agentJob struct {
+	timePeriod
+	Agent string
+}
+
+// queueKey identifies an agent queue. Queue names are only unique within an
+// organization since every organization has its own agents.
+type queueKey struct {
+	Org   string
+	Queue string
+}
+
+// queueTimeline collects the jobs run on an agent queue to reconstruct how
+// many of them were running concurrently over time.
+type queueTimeline struct {
+	Org   string
+	Queue string
+	jobs  []agentJob
+}
+
+func (t *queueTimeline) add(j Job) {
+	if _, ok := j.Duration(); !ok {
+		return
+	}
+	agent := j.AgentID
+	if agent == "" {
+		agent = j.AgentName
+	}
+	t.jobs = append(t.jobs, agentJob{timePeriod{j.StartedAt, j.FinishedAt}, agent})
+}
+
+// Steps returns the number of running jobs over time, ordered by time.
+func (t *queueTimeline) Steps() []concurrencyStep {
+	type event struct {
+		When  time.Time
+		Delta int
+	}
+	events := make([]event, 0, 2*len(t.jobs))
+	for _, j := range t.jobs {
+		events = append(events, event{j.From, 1}, event{j.To, -1})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].When.Equal(events[j].When) {
+			return events[i].When.Before(events[j].When)
+		}
+		// Finish jobs before starting new ones to not count an agent
+		// picking up its next job as two running jobs.
+		return events[i].Delta < events[j].Delta
+	})
+
+	var res []concurrencyStep
+	var running int
+	for _, e := range events {
+		running += e.Delta
+		if n := len(res); n > 0 && res[n-1].When.Equal(e.When) {
+			res[n-1].Running = running
+		} else {
+			res = append(res, concurrencyStep{e.When, running})
+		}
+	}
+	return res
+}
+
+// StepsBetween returns the steps within [from, to), starting with the number
+// of jobs running at from.
+func (t *queueTimeline) StepsBetween(from, to time.Time) []concurrencyStep {
+	res := []concurrencyStep{{When: from}}
+	for _, s := range t.Steps() {
+		switch {
+		case !s.When.After(from):
+			res[0].Running = s.Running
+		case s.When.Before(to):
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// agentsPerHour is the number of distinct agents that ran a job on the queue
+// each hour. It is used as an approximation of the size of an autoscaled
+// agent fleet.
+func (t *queueTimeline) agentsPerHour() map[time.Time]int {
+	agents := make(map[time.Time]map[string]bool)
+	for _, j := range t.jobs {
+		if j.Agent == "" {
+			continue
+		}
+		for hour := j.From.Truncate(time.Hour); hour.Before(j.To); hour = hour.Add(time.Hour) {
+			if agents[hour] == nil {
+				agents[hour] = make(map[string]bool)
+			}
+			agents[hour][j.Agent] = true
+		}
+	}
+
+	res := make(map[time.Time]int, len(agents))
+	for hour, a := range agents {
+		res[hour] = len(a)
+	}
+	return res
+}
+
+// queueUtilization summarizes the concurrency timeline of an agent queue.
+type queueUtilization struct {
+	Org    string
+	Queue  string
+	Jobs   int
+	Agents int
+
+	Peak   int
+	PeakAt time.Time
+
+	// Idle is the total time without any running jobs.
+	Idle        time.Duration
+	LongestIdle timePeriod
+
+	// Saturated is the total time when all agents were busy, as far as we can
+	// tell from agentsPerHour. Long saturation periods imply that jobs had to
+	// wait for an agent.
+	Saturated         time.Duration
+	SaturationPeriods []timePeriod
+}
+
+// maxSaturationPeriods is how many of the longest saturation periods are
+// kept by Utilization.
+const maxSaturationPeriods = 10
+
+// Utilization summarizes the timeline within [from, to). Only jobs running
+// during it are counted.
+func (t *queueTimeline) Utilization(from, to time.Time) queueUtilization {
+	res := queueUtilization{Org: t.Org, Queue: t.Queue}
+
+	agents := make(map[string]bool)
+	for _, j := range t.jobs {
+		if !j.From.Before(to) || !j.To.After(from) {
+			continue
+		}
+		res.Jobs++
+		if j.Agent != "" {
+			agents[j.Agent] = true
+		}
+	}
+	res.Agents = len(agents)
+
+	capacity := t.agentsPerHour()
+	steps := t.Steps()
+
+	var saturated *timePeriod
+	endSaturation := func() {
+		if saturated != nil {
+			res.Saturated += saturated.Duration()
+			res.SaturationPeriods = append(res.SaturationPeriods, *saturated)
+			saturated = nil
+		}
+	}
+
+	running := 0
+	for i := -1; i < len(steps); i++ {
+		start, end := from, to
+		if i >= 0 {
+			start = steps[i].When
+			running = steps[i].Running
+		}
+		if i+1 < len(steps) {
+			end = steps[i+1].When
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !start.Before(end) {
+			continue
+		}
+
+		if running > res.Peak {
+			res.Peak, res.PeakAt = running, start
+		}
+
+		if running == 0 {
+			idle := timePeriod{start, end}
+			res.Idle += idle.Duration()
+			if idle.Duration() > res.LongestIdle.Duration() {
+				res.LongestIdle = idle
+			}
+		}
+
+		// Capacity changes every hour, so saturation is evaluated per hour.
+		for segmentStart := start; segmentStart.Before(end); {
+			segmentEnd := segmentStart.Truncate(time.Hour).Add(time.Hour)
+			if segmentEnd.After(end) {
+				segmentEnd = end
+			}
+
+			if c := capacity[segmentStart.Truncate(time.Hour)]; c > 0 && running >= c {
+				if saturated == nil {
+					saturated = &timePeriod{segmentStart, segmentEnd}
+				} else {
+					saturated.To = segmentEnd
+				}
+			} else {
+				endSaturation()
+			}
+
+			segmentStart = segmentEnd
+		}
+	}
+	endSaturation()
+
+	sort.Slice(res.SaturationPeriods, func(i, j int) bool {
+		return res.SaturationPeriods[i].Duration() > res.SaturationPeriods[j].Duration()
+	})
+	if len(res.SaturationPeriods) > maxSaturationPeriods {
+		res.SaturationPeriods = res.SaturationPeriods[:maxSaturationPeriods]
+	}
+
+	return res
+}
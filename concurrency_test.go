@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueueTimelineUtilization(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hour, minute int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+	job := func(agent string, from, to time.Time) Job {
+		return Job{AgentID: agent, RunnableAt: from, StartedAt: from, FinishedAt: to}
+	}
+
+	timeline := &queueTimeline{Queue: "default"}
+	for _, j := range []Job{
+		// Before the period, as fetched thanks to concurrencyLookback.
+		job("a1", at(8, 0), at(9, 0)),
+		// Started before the period and still running at its start.
+		job("a1", at(9, 30), at(10, 30)),
+		job("a2", at(10, 0), at(11, 0)),
+		// a1 picks up its next job right away.
+		job("a1", at(10, 30), at(11, 0)),
+		job("a1", at(12, 0), at(12, 30)),
+		// Never ran.
+		{AgentID: "a3", RunnableAt: at(10, 0)},
+	} {
+		timeline.add(j)
+	}
+	from, to := at(10, 0), at(13, 0)
+
+	got := timeline.Utilization(from, to)
+	want := queueUtilization{
+		Queue:       "default",
+		Jobs:        4,
+		Agents:      2,
+		Peak:        2,
+		PeakAt:      at(10, 0),
+		Idle:        90 * time.Minute,
+		LongestIdle: timePeriod{at(11, 0), at(12, 0)},
+		Saturated:   90 * time.Minute,
+		SaturationPeriods: []timePeriod{
+			{at(10, 0), at(11, 0)},
+			{at(12, 0), at(12, 30)},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Utilization() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	steps := timeline.StepsBetween(from, to)
+	wantSteps := []concurrencyStep{
+		{at(10, 0), 2},
+		{at(10, 30), 2},
+		{at(11, 0), 0},
+		{at(12, 0), 1},
+		{at(12, 30), 0},
+	}
+	if !reflect.DeepEqual(steps, wantSteps) {
+		t.Errorf("StepsBetween() = %+v, want %+v", steps, wantSteps)
+	}
+}
+
+func TestQueueTimelineUtilizationWithoutJobs(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(2 * time.Hour)
+
+	got := (&queueTimeline{Queue: "empty"}).Utilization(from, to)
+	want := queueUtilization{
+		Queue:       "empty",
+		Idle:        2 * time.Hour,
+		LongestIdle: timePeriod{from, to},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Utilization() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the structure of the file given by --config. Flags given on the
+// command line take precedence over it.
+type Config struct {
+	// Token is the Buildkite API token. Like --buildkite-token, it can be
+	// read from a file using "@path".
+	Token string `json:"token"`
+	Org   string `json:"org"`
+
+	// Orgs are scraped instead of Org to collect builds from several
+	// organizations.
+	Orgs []OrgConfig `json:"orgs"`
+
+	Cache         CacheConfig    `json:"cache"`
+	ScrapeHistory configDuration `json:"scrape_history"`
+
+	// Reports are used unless reports are given using --report.
+	Reports []JSONQuery `json:"reports"`
+}
+
+type OrgConfig struct {
+	Name string `json:"name"`
+
+	// Token defaults to the top level token.
+	Token string `json:"token"`
+}
+
+type CacheConfig struct {
+	Backend            string         `json:"backend"`
+	Memcache           []string       `json:"memcache"`
+	File               string         `json:"file"`
+	CompactionInterval configDuration `json:"compaction_interval"`
+	LocalMaxAge        configDuration `json:"local_max_age"`
+}
+
+// configDuration is a time.Duration written like "24h" in a config file.
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(v)
+	return nil
+}
+
+// loadConfig reads a JSON or, given a .yaml or .yml extension, YAML config
+// file.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return cfg, err
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Typos would otherwise silently be ignored.
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Org != "" && len(cfg.Orgs) > 0 {
+		return cfg, fmt.Errorf("org and orgs are mutually exclusive")
+	}
+	seen := make(map[string]bool)
+	for i, o := range cfg.Orgs {
+		if o.Name == "" {
+			return cfg, fmt.Errorf("orgs[%d]: name is required", i)
+		}
+		if seen[o.Name] {
+			return cfg, fmt.Errorf("orgs[%d]: duplicate org %q", i, o.Name)
+		}
+		seen[o.Name] = true
+	}
+
+	switch cfg.Cache.Backend {
+	case "", "memcache", "disk":
+	default:
+		return cfg, fmt.Errorf("cache: unrecognized backend %q", cfg.Cache.Backend)
+	}
+	return cfg, nil
+}
+
+// yamlToJSON converts YAML to JSON to be able to decode both formats using the
+// JSON struct tags, which JSONQuery already has.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v, err := jsonCompatible(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonCompatible replaces the map[interface{}]interface{} maps produced by
+// the YAML decoder with maps encoding/json can handle.
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("unsupported non-string key: %v", k)
+			}
+			converted, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			res[key] = converted
+		}
+		return res, nil
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, e := range v {
+			converted, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = converted
+		}
+		return res, nil
+	default:
+		return v, nil
+	}
+}
+
+// applyConfig sets the flags that were not given on the command line from
+// cfg.
+// changedStartupSettings returns the names of the settings that differ
+// between two configs and are only read at start. That is everything but the
+// reports. Token files are only compared by path.
+func changedStartupSettings(old, new Config) []string {
+	var res []string
+	if old.Token != new.Token {
+		res = append(res, "token")
+	}
+	if old.Org != new.Org {
+		res = append(res, "org")
+	}
+	if !reflect.DeepEqual(old.Orgs, new.Orgs) {
+		res = append(res, "orgs")
+	}
+	if !reflect.DeepEqual(old.Cache, new.Cache) {
+		res = append(res, "cache")
+	}
+	if old.ScrapeHistory != new.ScrapeHistory {
+		res = append(res, "scrape_history")
+	}
+	return res
+}
+
+func applyConfig(cfg Config) {
+	set := flagsSetByUser()
+
+	setString := func(flag string, dst *string, v string) {
+		if v != "" && !set[flag] {
+			*dst = v
+		}
+	}
+	setDuration := func(flag string, dst *time.Duration, v configDuration) {
+		if v != 0 && !set[flag] {
+			*dst = time.Duration(v)
+		}
+	}
+
+	setString("buildkite-token", apiToken, cfg.Token)
+	setString("buildkite-org", org, cfg.Org)
+	setString("cache", cacheBackend, cfg.Cache.Backend)
+	setString("cache-file", cacheFile, cfg.Cache.File)
+	if len(cfg.Cache.Memcache) > 0 && !set["memcache"] {
+		*memcachedAddrs = cfg.Cache.Memcache
+	}
+	setDuration("cache-compaction-interval", cacheCompactionInterval, cfg.Cache.CompactionInterval)
+	setDuration("local-cache-max-age", localCacheMaxAge, cfg.Cache.LocalMaxAge)
+	setDuration("scrape-history", scrapeHistory, cfg.ScrapeHistory)
+}
+
+// flagsSetByUser returns the names of the flags given on the command line, as
+// opposed to having their default value.
+func flagsSetByUser() map[string]bool {
+	res := make(map[string]bool)
+	ctx, err := kingpin.CommandLine.ParseContext(os.Args[1:])
+	if err != nil {
+		// Can't happen since the command line already has been parsed.
+		return res
+	}
+	for _, e := range ctx.Elements {
+		if f, ok := e.Clause.(*kingpin.FlagClause); ok {
+			res[f.Model().Name] = true
+		}
+	}
+	return res
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangedStartupSettings(t *testing.T) {
+	old := Config{
+		Token:         "@/secrets/token",
+		Orgs:          []OrgConfig{{Name: "first"}, {Name: "second", Token: "second-token"}},
+		ScrapeHistory: configDuration(24 * time.Hour),
+		Reports:       []JSONQuery{{Name: "Old"}},
+	}
+
+	reportsOnly := old
+	reportsOnly.Reports = []JSONQuery{{Name: "New"}}
+	if got := changedStartupSettings(old, reportsOnly); len(got) != 0 {
+		t.Errorf("changedStartupSettings() = %v for changed reports, want none", got)
+	}
+
+	changed := old
+	changed.Orgs = []OrgConfig{{Name: "first"}, {Name: "second", Token: "rotated-token"}}
+	changed.ScrapeHistory = configDuration(48 * time.Hour)
+	want := []string{"orgs", "scrape_history"}
+	if got := changedStartupSettings(old, changed); !reflect.DeepEqual(got, want) {
+		t.Errorf("changedStartupSettings() = %v, want %v", got, want)
+	}
+}
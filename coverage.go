@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Coverage tells for which part of the requested time range builds could be
+// fetched. Builds created during a failed interval are missing from the
+// iteration.
+type Coverage struct {
+	// Intervals is the number of intervals the time range was split into,
+	// counted once per organization.
+	Intervals int
+	Failed    []FailedInterval
+
+	// fetched are all intervals builds were fetched for, to not count an
+	// interval twice when merging coverages.
+	fetched map[orgInterval]bool
+}
+
+type FailedInterval struct {
+	timeInterval
+
+	// Org is the organization whose builds are missing.
+	Org string
+	Err error
+}
+
+// Error describes the failure along with the organization it happened for.
+func (f FailedInterval) Error() string {
+	return fmt.Sprintf("%s: %s", f.Org, f.Err)
+}
+
+// orgInterval identifies an interval of an organization.
+type orgInterval struct {
+	Org  string
+	From int64
+}
+
+func newCoverage(org string, intervals []timeInterval) Coverage {
+	res := Coverage{
+		Intervals: len(intervals),
+		fetched:   make(map[orgInterval]bool, len(intervals)),
+	}
+	for _, i := range intervals {
+		res.fetched[orgInterval{org, i.From.UnixNano()}] = true
+	}
+	return res
+}
+
+func (c Coverage) Complete() bool {
+	return len(c.Failed) == 0
+}
+
+// Empty returns whether no builds at all could be fetched, which is the case
+// if every interval of every organization failed.
+func (c Coverage) Empty() bool {
+	return c.Intervals > 0 && len(c.Failed) >= c.Intervals
+}
+
+// Merge returns the coverage of data aggregated from two iterations, which
+// can be of different organizations or overlapping time ranges. An interval
+// is missing if it failed in either.
+func (c Coverage) Merge(o Coverage) Coverage {
+	res := Coverage{fetched: make(map[orgInterval]bool, len(c.fetched)+len(o.fetched))}
+	for _, fetched := range []map[orgInterval]bool{c.fetched, o.fetched} {
+		for k := range fetched {
+			res.fetched[k] = true
+		}
+	}
+	res.Intervals = len(res.fetched)
+
+	seen := make(map[orgInterval]bool)
+	for _, failed := range [][]FailedInterval{c.Failed, o.Failed} {
+		for _, f := range failed {
+			k := orgInterval{f.Org, f.From.UnixNano()}
+			if !seen[k] {
+				seen[k] = true
+				res.Failed = append(res.Failed, f)
+			}
+		}
+	}
+	sort.Slice(res.Failed, func(i, j int) bool {
+		if !res.Failed[i].From.Equal(res.Failed[j].From) {
+			return res.Failed[i].From.Before(res.Failed[j].From)
+		}
+		return res.Failed[i].Org < res.Failed[j].Org
+	})
+	return res
+}
+
+// Missing returns the periods during which builds of any organization are
+// missing, with adjacent intervals joined.
+func (c Coverage) Missing() []timePeriod {
+	var res []timePeriod
+	for _, f := range c.Failed {
+		if len(res) > 0 && !f.From.After(res[len(res)-1].To) {
+			if f.To.After(res[len(res)-1].To) {
+				res[len(res)-1].To = f.To
+			}
+			continue
+		}
+		res = append(res, timePeriod{f.From, f.To})
+	}
+	return res
+}
+
+// respondFetchError responds with an error and returns true if there are no
+// builds to show. Otherwise, it flags a response based on incomplete data with
+// the X-Missing-Intervals header. Pages must also show the missing periods,
+// using printReportTopHtml or printCoverageWarning, and charts using
+// markIncomplete.
+func respondFetchError(w http.ResponseWriter, c Coverage, err error) bool {
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to fetch builds: %s", err), http.StatusInternalServerError)
+		return true
+	}
+	if c.Empty() {
+		http.Error(w, fmt.Sprintf("unable to fetch builds: %s", c.Failed[0]), http.StatusBadGateway)
+		return true
+	}
+	setCoverageHeader(w, c)
+	return false
+}
+
+func setCoverageHeader(w http.ResponseWriter, c Coverage) {
+	if !c.Complete() {
+		w.Header().Set("X-Missing-Intervals", strconv.Itoa(len(c.Failed)))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCoverageMerge(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	intervals := generateIntervals(start, start.Add(4*time.Hour), time.Hour)
+	failed := func(org string, indexes ...int) Coverage {
+		c := newCoverage(org, intervals)
+		for _, i := range indexes {
+			c.Failed = append(c.Failed, FailedInterval{intervals[i], org, errors.New("boom")})
+		}
+		return c
+	}
+
+	for _, test := range []struct {
+		name          string
+		coverages     []Coverage
+		wantIntervals int
+		wantFailed    int
+		wantEmpty     bool
+		wantMissing   []timePeriod
+	}{
+		{
+			name:          "same organization",
+			coverages:     []Coverage{failed("a", 0), failed("a", 0, 1)},
+			wantIntervals: 4,
+			wantFailed:    2,
+			wantMissing:   []timePeriod{{intervals[0].From, intervals[1].To}},
+		},
+		{
+			name:          "one of two organizations failing",
+			coverages:     []Coverage{failed("a", 0, 1, 2, 3), failed("b")},
+			wantIntervals: 8,
+			wantFailed:    4,
+			wantMissing:   []timePeriod{{intervals[0].From, intervals[3].To}},
+		},
+		{
+			name:          "all organizations failing",
+			coverages:     []Coverage{failed("a", 0, 1, 2, 3), failed("b", 0, 1, 2, 3)},
+			wantIntervals: 8,
+			wantFailed:    8,
+			wantEmpty:     true,
+			wantMissing:   []timePeriod{{intervals[0].From, intervals[3].To}},
+		},
+		{
+			name:          "same interval of two organizations",
+			coverages:     []Coverage{failed("a", 1), failed("b", 1, 3)},
+			wantIntervals: 8,
+			wantFailed:    3,
+			wantMissing:   []timePeriod{{intervals[1].From, intervals[1].To}, {intervals[3].From, intervals[3].To}},
+		},
+		{
+			name: "overlapping time ranges",
+			coverages: []Coverage{
+				{Intervals: 3, Failed: failed("a", 2).Failed, fetched: newCoverage("a", intervals[:3]).fetched},
+				{Intervals: 2, Failed: failed("a", 2).Failed, fetched: newCoverage("a", intervals[2:]).fetched},
+			},
+			wantIntervals: 4,
+			wantFailed:    1,
+			wantMissing:   []timePeriod{{intervals[2].From, intervals[2].To}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var c Coverage
+			for _, o := range test.coverages {
+				c = c.Merge(o)
+			}
+			if c.Intervals != test.wantIntervals {
+				t.Errorf("Intervals = %d, want %d", c.Intervals, test.wantIntervals)
+			}
+			if len(c.Failed) != test.wantFailed {
+				t.Errorf("len(Failed) = %d, want %d", len(c.Failed), test.wantFailed)
+			}
+			if c.Empty() != test.wantEmpty {
+				t.Errorf("Empty() = %v, want %v", c.Empty(), test.wantEmpty)
+			}
+			missing := c.Missing()
+			if len(missing) != len(test.wantMissing) {
+				t.Fatalf("Missing() = %v, want %v", missing, test.wantMissing)
+			}
+			for i := range missing {
+				if !missing[i].From.Equal(test.wantMissing[i].From) || !missing[i].To.Equal(test.wantMissing[i].To) {
+					t.Errorf("Missing() = %v, want %v", missing, test.wantMissing)
+				}
+			}
+		})
+	}
+}
+
+func TestRespondFetchErrorNamesOrganization(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	intervals := generateIntervals(start, start.Add(time.Hour), time.Hour)
+	var c Coverage
+	for _, org := range []string{"b", "a"} {
+		o := newCoverage(org, intervals)
+		o.Failed = []FailedInterval{{intervals[0], org, errors.New("boom")}}
+		c = c.Merge(o)
+	}
+
+	w := httptest.NewRecorder()
+	if !respondFetchError(w, c, nil) {
+		t.Fatal("expected an error response when every organization failed")
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if want := "unable to fetch builds: a: boom\n"; w.Body.String() != want {
+		t.Errorf("body = %q, want %q", w.Body.String(), want)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// criticalPath reconstructs the chain of jobs that determined the wall-clock
+// duration of a build. Buildkite does not tell us how steps depend on each
+// other, so dependencies are inferred from the timeline: working backwards
+// from the job that finished last, the predecessor of a job is the job that
+// finished last before it became runnable.
+//
+// The returned jobs are ordered from last to first.
+func criticalPath(jobs []Job) []Job {
+	var candidates []Job
+	for _, j := range jobs {
+		if _, ok := j.Duration(); ok {
+			candidates = append(candidates, j)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].FinishedAt.After(candidates[j].FinishedAt)
+	})
+
+	path := []Job{candidates[0]}
+	current := candidates[0]
+	for _, j := range candidates[1:] {
+		if !j.FinishedAt.After(readyAt(current)) {
+			path = append(path, j)
+			current = j
+		}
+	}
+	return path
+}
+
+// readyAt is when a job had all its dependencies satisfied.
+func readyAt(j Job) time.Time {
+	if !j.RunnableAt.IsZero() {
+		return j.RunnableAt
+	}
+	return j.StartedAt
+}
+
+// criticalPathStep aggregates how a step contributed to the critical path of
+// the builds of a group.
+type criticalPathStep struct {
+	Name string
+
+	// OnPath is the number of builds where the step was on the critical path.
+	OnPath int
+
+	// Duration is the total time the step spent on the critical path.
+	Duration time.Duration
+}
+
+func (s criticalPathStep) Average() time.Duration {
+	if s.OnPath == 0 {
+		return 0
+	}
+	return s.Duration / time.Duration(s.OnPath)
+}
+
+// criticalPathGroup aggregates critical paths for all builds in a group.
+type criticalPathGroup struct {
+	Name   string
+	Builds int
+	steps  map[string]*criticalPathStep
+}
+
+func newCriticalPathGroup(name string) *criticalPathGroup {
+	return &criticalPathGroup{
+		Name:  name,
+		steps: make(map[string]*criticalPathStep),
+	}
+}
+
+func (g *criticalPathGroup) add(b Build) {
+	path := criticalPath(b.Jobs)
+	if len(path) == 0 {
+		return
+	}
+	g.Builds++
+
+	// A step with parallelism might show up several times in a single path.
+	// Only count the build once.
+	seen := make(map[string]bool)
+	for _, j := range path {
+		s, ok := g.steps[j.Step()]
+		if !ok {
+			s = &criticalPathStep{Name: j.Step()}
+			g.steps[j.Step()] = s
+		}
+		if !seen[j.Step()] {
+			s.OnPath++
+			seen[j.Step()] = true
+		}
+		d, _ := j.Duration()
+		s.Duration += d
+	}
+}
+
+// Steps returns the steps ordered by how much time they spent on the critical
+// path; the first step is the one most worthwhile to optimize.
+func (g *criticalPathGroup) Steps() []criticalPathStep {
+	res := make([]criticalPathStep, 0, len(g.steps))
+	for _, s := range g.steps {
+		res = append(res, *s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Duration != res[j].Duration {
+			return res[i].Duration > res[j].Duration
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCriticalPath(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minute int) time.Time {
+		if minute < 0 {
+			return time.Time{}
+		}
+		return start.Add(time.Duration(minute) * time.Minute)
+	}
+	// job is runnable, started and finished at the given minutes. -1 leaves
+	// a timestamp unset.
+	job := func(label string, runnable, started, finished int) Job {
+		return Job{Label: label, RunnableAt: at(runnable), StartedAt: at(started), FinishedAt: at(finished)}
+	}
+
+	for _, test := range []struct {
+		name string
+		jobs []Job
+		want []string
+	}{
+		{
+			name: "no jobs",
+			want: nil,
+		},
+		{
+			name: "single job",
+			jobs: []Job{job("build", 0, 1, 5)},
+			want: []string{"build"},
+		},
+		{
+			name: "sequential steps separated by a wait step",
+			jobs: []Job{
+				job("build", 0, 0, 5),
+				job("test", 5, 7, 12),
+			},
+			want: []string{"test", "build"},
+		},
+		{
+			name: "parallel steps",
+			jobs: []Job{
+				job("build", 0, 0, 5),
+				job("lint", 5, 5, 8),
+				job("unit", 5, 6, 15),
+				job("integration", 5, 6, 11),
+				job("deploy", 15, 16, 20),
+			},
+			want: []string{"deploy", "unit", "build"},
+		},
+		{
+			name: "independent step finishing while another runs",
+			jobs: []Job{
+				job("build", 0, 0, 5),
+				job("docs", 0, 0, 3),
+				job("test", 5, 5, 10),
+			},
+			want: []string{"test", "build"},
+		},
+		{
+			name: "retried job",
+			jobs: []Job{
+				job("build", 0, 0, 5),
+				job("test", 5, 5, 8),
+				job("test", 8, 9, 14),
+			},
+			want: []string{"test", "test", "build"},
+		},
+		{
+			name: "unfinished jobs are ignored",
+			jobs: []Job{
+				job("build", 0, 0, 5),
+				job("canceled", 5, 6, -1),
+				job("never started", 5, -1, -1),
+				job("test", 5, 6, 10),
+			},
+			want: []string{"test", "build"},
+		},
+		{
+			name: "only unfinished jobs",
+			jobs: []Job{
+				job("canceled", 0, 1, -1),
+				job("never started", 0, -1, -1),
+			},
+			want: nil,
+		},
+		{
+			name: "started time is used without runnable time",
+			jobs: []Job{
+				job("build", -1, 0, 5),
+				job("test", -1, 6, 10),
+			},
+			want: []string{"test", "build"},
+		},
+	} {
+		var got []string
+		for _, j := range criticalPath(test.jobs) {
+			got = append(got, j.Label)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: criticalPath() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCriticalPathGroupCountsRetriedStepOnce(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	g := newCriticalPathGroup("group")
+	g.add(Build{Jobs: []Job{
+		{StepKey: "test", RunnableAt: start, StartedAt: start, FinishedAt: start.Add(3 * time.Minute)},
+		{StepKey: "test", RunnableAt: start.Add(3 * time.Minute), StartedAt: start.Add(3 * time.Minute), FinishedAt: start.Add(8 * time.Minute)},
+	}})
+
+	steps := g.Steps()
+	if g.Builds != 1 || len(steps) != 1 {
+		t.Fatalf("got %d builds and steps %+v, want 1 build with 1 step", g.Builds, steps)
+	}
+	if steps[0].OnPath != 1 || steps[0].Duration != 8*time.Minute {
+		t.Errorf("step = %+v, want on the path once for 8m", steps[0])
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var errCacheMiss = errors.New("cache miss")
+
+// DiskCache is a Cache persisted to a single append-only file, which allows
+// running without memcached and to keep the cache across restarts.
+//
+// Every Put appends a record to the file and an in-memory index keeps track
+// of where the latest value of each key is. Overwritten and expired records
+// are left in the file until it is compacted. The file is locked while open
+// since the index of another process would go stale, and their appends
+// would overwrite each other.
+type DiskCache struct {
+	path string
+
+	mutex   sync.RWMutex
+	file    *os.File
+	index   map[string]diskCacheEntry
+	size    int64
+	garbage int64
+}
+
+type diskCacheEntry struct {
+	// offset and length of the value in the file.
+	offset  int64
+	length  int64
+	expires time.Time
+
+	// recordSize is the size of the whole record, used to keep track of how
+	// much garbage is in the file.
+	recordSize int64
+}
+
+// A record is a header followed by the key, the value and a CRC32 checksum of
+// everything preceding it.
+const diskCacheHeaderSize = 4 + 4 + 8
+
+// OpenDiskCache opens, or creates, a cache file. A partially written record at
+// the end of the file, for example after a crash, is discarded. Fails if the
+// file is used by another process.
+func OpenDiskCache(path string) (*DiskCache, error) {
+	c := &DiskCache{path: path}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *DiskCache) open() error {
+	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := lockDiskCacheFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return c.load(f)
+}
+
+// load builds the index of a locked file. Closes the file on failure.
+func (c *DiskCache) load(f *os.File) error {
+	index, size, garbage, err := readDiskCacheIndex(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+
+	c.file, c.index, c.size, c.garbage = f, index, size, garbage
+	return nil
+}
+
+// readDiskCacheIndex scans all records of a file and returns the index and the
+// size of the valid part of the file.
+func readDiskCacheIndex(f *os.File) (index map[string]diskCacheEntry, size int64, garbage int64, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	index = make(map[string]diskCacheEntry)
+	r := bufio.NewReader(f)
+	for {
+		key, entry, err := readDiskCacheRecord(r, size, info.Size())
+		if err == io.EOF {
+			return index, size, garbage, nil
+		}
+		if err == io.ErrUnexpectedEOF || err == errCorruptRecord {
+			log.Printf("discarding corrupt cache file tail at offset %d in %s", size, f.Name())
+			return index, size, garbage, nil
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		if old, ok := index[key]; ok {
+			garbage += old.recordSize
+		}
+		index[key] = entry
+		size += entry.recordSize
+	}
+}
+
+var errCorruptRecord = errors.New("corrupt cache record")
+
+// readDiskCacheRecord reads the record at offset of a file of fileSize bytes.
+func readDiskCacheRecord(r io.Reader, offset, fileSize int64) (string, diskCacheEntry, error) {
+	var header [diskCacheHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", diskCacheEntry{}, err
+	}
+	keyLength := int64(binary.BigEndian.Uint32(header[0:4]))
+	valueLength := int64(binary.BigEndian.Uint32(header[4:8]))
+	expires := int64(binary.BigEndian.Uint64(header[8:16]))
+
+	// A corrupt header could otherwise make us allocate gigabytes.
+	if offset+diskCacheHeaderSize+keyLength+valueLength+4 > fileSize {
+		return "", diskCacheEntry{}, errCorruptRecord
+	}
+
+	body := make([]byte, keyLength+valueLength+4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", diskCacheEntry{}, err
+	}
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[:])
+	checksum.Write(body[:keyLength+valueLength])
+	if checksum.Sum32() != binary.BigEndian.Uint32(body[keyLength+valueLength:]) {
+		return "", diskCacheEntry{}, errCorruptRecord
+	}
+
+	return string(body[:keyLength]), diskCacheEntry{
+		offset:     offset + diskCacheHeaderSize + keyLength,
+		length:     valueLength,
+		expires:    time.Unix(0, expires),
+		recordSize: diskCacheHeaderSize + keyLength + valueLength + 4,
+	}, nil
+}
+
+func encodeDiskCacheRecord(k string, v []byte, expires time.Time) []byte {
+	record := make([]byte, diskCacheHeaderSize, diskCacheHeaderSize+len(k)+len(v)+4)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(k)))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(v)))
+	binary.BigEndian.PutUint64(record[8:16], uint64(expires.UnixNano()))
+	record = append(record, k...)
+	record = append(record, v...)
+
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(record))
+	return append(record, checksum[:]...)
+}
+
+func (c *DiskCache) Put(k string, v []byte, ttl time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	expires := time.Now().Add(ttl)
+	record := encodeDiskCacheRecord(k, v, expires)
+	if _, err := c.file.WriteAt(record, c.size); err != nil {
+		return err
+	}
+
+	if old, ok := c.index[k]; ok {
+		c.garbage += old.recordSize
+	}
+	c.index[k] = diskCacheEntry{
+		offset:     c.size + diskCacheHeaderSize + int64(len(k)),
+		length:     int64(len(v)),
+		expires:    expires,
+		recordSize: int64(len(record)),
+	}
+	c.size += int64(len(record))
+	return nil
+}
+
+func (c *DiskCache) Get(k string) ([]byte, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	entry, ok := c.index[k]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, errCacheMiss
+	}
+
+	v := make([]byte, entry.length)
+	if _, err := c.file.ReadAt(v, entry.offset); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Compact rewrites the cache file without overwritten and expired records.
+func (c *DiskCache) Compact() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tmpPath := c.path + ".compacting"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	// Locking before the file replaces the cache file to never leave the
+	// latter unlocked.
+	if err := lockDiskCacheFile(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	now := time.Now()
+	for k, entry := range c.index {
+		if now.After(entry.expires) {
+			continue
+		}
+		v := make([]byte, entry.length)
+		if _, err := c.file.ReadAt(v, entry.offset); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := w.Write(encodeDiskCacheRecord(k, v, entry.expires)); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// Closing before renaming since some platforms can't rename over open
+	// files. tmp is kept open to become the cache file, since reopening it by
+	// path would fail to take the lock tmp holds.
+	c.file.Close()
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		tmp.Close()
+		if reopenErr := c.open(); reopenErr != nil {
+			log.Println("unable to reopen cache file:", reopenErr)
+		}
+		return err
+	}
+	return c.adopt(tmp)
+}
+
+// adopt makes f, the file at the path of the cache, the cache file. If f is
+// unusable, the path is opened again to not leave the cache without a file.
+func (c *DiskCache) adopt(f *os.File) error {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+	} else {
+		err = c.load(f)
+	}
+	if err != nil {
+		if reopenErr := c.open(); reopenErr != nil {
+			log.Println("unable to reopen cache file:", reopenErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// compactionThreshold is the share of garbage in the file that triggers a
+// compaction in CompactEvery.
+const compactionThreshold = 0.5
+
+// CompactEvery periodically compacts the cache file if a large part of it is
+// garbage. Never returns.
+func (c *DiskCache) CompactEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !c.needsCompaction() {
+			continue
+		}
+		start := time.Now()
+		if err := c.Compact(); err != nil {
+			log.Println("unable to compact cache file:", err)
+			continue
+		}
+		log.Printf("compacted cache file in %s", time.Since(start))
+	}
+}
+
+func (c *DiskCache) needsCompaction() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	garbage := c.garbage
+	now := time.Now()
+	for _, entry := range c.index {
+		if now.After(entry.expires) {
+			garbage += entry.recordSize
+		}
+	}
+	return c.size > 0 && float64(garbage)/float64(c.size) >= compactionThreshold
+}
+
+func (c *DiskCache) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.file.Close()
+}
@@ -0,0 +1,22 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockDiskCacheFile takes an exclusive lock on a cache file, which is held
+// until the file is closed. Fails right away if another process holds it.
+func lockDiskCacheFile(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("%s is used by another process", f.Name())
+		}
+		return fmt.Errorf("unable to lock %s: %s", f.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+// lockDiskCacheFile is a no-op on platforms without flock. Sharing a cache file
+// between processes goes undetected there.
+func lockDiskCacheFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestDiskCache(t *testing.T, path string) *DiskCache {
+	t.Helper()
+	c, err := OpenDiskCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func assertCached(t *testing.T, c *DiskCache, k, want string) {
+	t.Helper()
+	v, err := c.Get(k)
+	if err != nil {
+		t.Fatalf("Get(%q): %s", k, err)
+	}
+	if string(v) != want {
+		t.Errorf("Get(%q) = %q, want %q", k, v, want)
+	}
+}
+
+func assertNotCached(t *testing.T, c *DiskCache, k string) {
+	t.Helper()
+	if v, err := c.Get(k); err != errCacheMiss {
+		t.Errorf("Get(%q) = %q, %v, want a miss", k, v, err)
+	}
+}
+
+func TestDiskCacheRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	c := openTestDiskCache(t, path)
+
+	puts := []struct {
+		k, v string
+		ttl  time.Duration
+	}{
+		{"a", "first", time.Hour},
+		{"b", "", time.Hour},
+		{"a", "overwritten", time.Hour},
+		{"expired", "value", -time.Second},
+	}
+	for _, p := range puts {
+		if err := c.Put(p.k, []byte(p.v), p.ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(c *DiskCache) {
+		assertCached(t, c, "a", "overwritten")
+		assertCached(t, c, "b", "")
+		assertNotCached(t, c, "expired")
+		assertNotCached(t, c, "missing")
+	}
+	check(c)
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c = openTestDiskCache(t, path)
+	defer c.Close()
+	check(c)
+}
+
+func TestDiskCacheDiscardsCorruptTail(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		corrupt func(t *testing.T, path string, lastRecordSize int64)
+	}{
+		{"truncated value", func(t *testing.T, path string, lastRecordSize int64) {
+			truncateBy(t, path, 5)
+		}},
+		{"truncated header", func(t *testing.T, path string, lastRecordSize int64) {
+			truncateBy(t, path, lastRecordSize-3)
+		}},
+		{"garbage header", func(t *testing.T, path string, lastRecordSize int64) {
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Key and value lengths of almost 4 GB each.
+			garbage := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+			if _, err := f.WriteAt(garbage, info.Size()-lastRecordSize); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"bad checksum", func(t *testing.T, path string, lastRecordSize int64) {
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt([]byte{0xff}, info.Size()-1); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache")
+			c := openTestDiskCache(t, path)
+			if err := c.Put("kept", []byte("value"), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Put("lost", []byte("partially written"), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			lastRecordSize := c.index["lost"].recordSize
+			c.Close()
+
+			test.corrupt(t, path, lastRecordSize)
+
+			c = openTestDiskCache(t, path)
+			assertCached(t, c, "kept", "value")
+			assertNotCached(t, c, "lost")
+
+			// The tail is truncated for new records to be readable.
+			if err := c.Put("new", []byte("value"), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+			c = openTestDiskCache(t, path)
+			assertCached(t, c, "kept", "value")
+			assertCached(t, c, "new", "value")
+			c.Close()
+		})
+	}
+}
+
+func truncateBy(t *testing.T, path string, n int64) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskCacheCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	c := openTestDiskCache(t, path)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := c.Put("overwritten", []byte("value"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Put("expired", []byte("value"), -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("kept", []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !c.needsCompaction() {
+		t.Fatal("expected the cache to need compaction")
+	}
+
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if c.needsCompaction() {
+		t.Error("expected no garbage after compaction")
+	}
+	want := c.index["overwritten"].recordSize + c.index["kept"].recordSize
+	if c.size != want {
+		t.Errorf("size = %d, want %d", c.size, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != want {
+		t.Errorf("file size = %d, want %d", info.Size(), want)
+	}
+	assertCached(t, c, "overwritten", "value")
+	assertCached(t, c, "kept", "value")
+	assertNotCached(t, c, "expired")
+
+	// The compacted file stays locked and writable.
+	if _, err := OpenDiskCache(path); err == nil {
+		t.Error("expected the compacted file to be locked")
+	}
+	if err := c.Put("new", []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertCached(t, c, "new", "value")
+}
+
+func TestDiskCacheCompactReopensUnusableFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	c := openTestDiskCache(t, path)
+	defer c.Close()
+
+	if err := c.Put("kept", []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// As if the compacted file was renamed into place, but its handle can't
+	// be used.
+	f := c.file
+	f.Close()
+	if err := c.adopt(f); err == nil {
+		t.Fatal("expected adopting a closed file to fail")
+	}
+
+	assertCached(t, c, "kept", "value")
+	if _, err := OpenDiskCache(path); err == nil {
+		t.Error("expected the reopened file to be locked")
+	}
+	if err := c.Put("new", []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	assertCached(t, c, "new", "value")
+}
+
+func TestDiskCacheLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	c := openTestDiskCache(t, path)
+
+	if _, err := OpenDiskCache(path); err == nil {
+		t.Fatal("expected a second open to fail")
+	}
+
+	c.Close()
+	c = openTestDiskCache(t, path)
+	c.Close()
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// buildFilter is a compiled filter expression, like
+//
+//	state == "passed" && source != "schedule" && author.email endsWith "@example.com"
+//
+// The grammar is
+//
+//	expr       = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" expr ")" | comparison
+//	comparison = field operator value
+//
+// where a value is a double quoted string or an integer. String fields
+// support ==, !=, =~ and !~ (regexp match), contains, startsWith and
+// endsWith. number also supports <, <=, > and >=.
+type buildFilter func(Build) bool
+
+// filterFields are the string fields of a build that can be filtered on.
+// meta_data.<key> is handled separately.
+var filterFields = map[string]func(Build) string{
+	"org":           func(b Build) string { return b.Org },
+	"pipeline":      func(b Build) string { return b.Pipeline.Name },
+	"branch":        func(b Build) string { return b.Branch },
+	"state":         func(b Build) string { return b.State },
+	"source":        func(b Build) string { return b.Source },
+	"commit":        func(b Build) string { return b.Commit },
+	"message":       func(b Build) string { return b.Message },
+	"web_url":       func(b Build) string { return b.WebURL },
+	"author.name":   func(b Build) string { return b.Author.Name },
+	"author.email":  func(b Build) string { return b.Author.Email },
+	"creator.name":  func(b Build) string { return b.Creator.Name },
+	"creator.email": func(b Build) string { return b.Creator.Email },
+	"pull_request": func(b Build) string {
+		if b.PullRequest == nil {
+			return ""
+		}
+		return b.PullRequest.ID
+	},
+	"pull_request.base": func(b Build) string {
+		if b.PullRequest == nil {
+			return ""
+		}
+		return b.PullRequest.Base
+	},
+	"pull_request.repository": func(b Build) string {
+		if b.PullRequest == nil {
+			return ""
+		}
+		return b.PullRequest.Repository
+	},
+}
+
+const metaDataFieldPrefix = "meta_data."
+
+// parseFilter compiles a filter expression. An empty expression matches all
+// builds.
+func parseFilter(s string) (buildFilter, error) {
+	if strings.TrimSpace(s) == "" {
+		return func(Build) bool { return true }, nil
+	}
+	tokens, err := lexFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != filterEOF {
+		return nil, p.unexpected(t, "&&, || or the end of the filter")
+	}
+	return f, nil
+}
+
+type filterTokenKind int
+
+const (
+	filterEOF filterTokenKind = iota
+	filterIdent
+	filterString
+	filterNumber
+	filterOperator
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+
+	// pos is the 1-based position of the token in the expression.
+	pos int
+}
+
+// filterOperators are ordered to match the longest operator first.
+var filterOperators = []string{"&&", "||", "==", "!=", "=~", "!~", "<=", ">=", "<", ">", "!", "(", ")"}
+
+func lexFilter(s string) ([]filterToken, error) {
+	var res []filterToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("position %d: unterminated string", i+1)
+			}
+			text, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("position %d: invalid string: %s", i+1, err)
+			}
+			res = append(res, filterToken{filterString, text, i + 1})
+			i = end + 1
+		case c == '-' || unicode.IsDigit(c):
+			end := i + 1
+			for end < len(s) && unicode.IsDigit(rune(s[end])) {
+				end++
+			}
+			res = append(res, filterToken{filterNumber, s[i:end], i + 1})
+			i = end
+		case c == '_' || unicode.IsLetter(c):
+			end := i + 1
+			for end < len(s) && (s[end] == '_' || s[end] == '.' || s[end] == '-' || unicode.IsLetter(rune(s[end])) || unicode.IsDigit(rune(s[end]))) {
+				end++
+			}
+			res = append(res, filterToken{filterIdent, s[i:end], i + 1})
+			i = end
+		default:
+			op := ""
+			for _, o := range filterOperators {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("position %d: unexpected %q", i+1, c)
+			}
+			res = append(res, filterToken{filterOperator, op, i + 1})
+			i += len(op)
+		}
+	}
+	return append(res, filterToken{filterEOF, "", len(s) + 1}), nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	next   int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) consume() filterToken {
+	t := p.tokens[p.next]
+	if t.kind != filterEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *filterParser) unexpected(t filterToken, expected string) error {
+	if t.kind == filterEOF {
+		return fmt.Errorf("position %d: expected %s, got the end of the filter", t.pos, expected)
+	}
+	return fmt.Errorf("position %d: expected %s, got %q", t.pos, expected, t.text)
+}
+
+func (p *filterParser) isOperator(text string) bool {
+	t := p.peek()
+	return t.kind == filterOperator && t.text == text
+}
+
+func (p *filterParser) parseOr() (buildFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("||") {
+		p.consume()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(b Build) bool { return l(b) || right(b) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (buildFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("&&") {
+		p.consume()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(b Build) bool { return l(b) && right(b) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (buildFilter, error) {
+	switch {
+	case p.isOperator("!"):
+		p.consume()
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(b Build) bool { return !f(b) }, nil
+	case p.isOperator("("):
+		p.consume()
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOperator(")") {
+			return nil, p.unexpected(p.peek(), ")")
+		}
+		p.consume()
+		return f, nil
+	default:
+		return p.parseComparison()
+	}
+}
+
+func (p *filterParser) parseComparison() (buildFilter, error) {
+	field := p.consume()
+	if field.kind != filterIdent {
+		return nil, p.unexpected(field, "a field, ! or (")
+	}
+	op := p.consume()
+	if op.kind != filterOperator && op.kind != filterIdent {
+		return nil, p.unexpected(op, "an operator")
+	}
+	value := p.consume()
+	if value.kind != filterString && value.kind != filterNumber {
+		return nil, p.unexpected(value, "a string or number")
+	}
+
+	if field.text == "number" {
+		return compileNumberComparison(op, value)
+	}
+	get, ok := filterFields[field.text]
+	if strings.HasPrefix(field.text, metaDataFieldPrefix) {
+		key := strings.TrimPrefix(field.text, metaDataFieldPrefix)
+		get, ok = func(b Build) string { return b.MetaData[key] }, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("position %d: unknown field %q", field.pos, field.text)
+	}
+	if value.kind != filterString {
+		return nil, fmt.Errorf("position %d: %s must be compared to a string", value.pos, field.text)
+	}
+	match, err := compileStringOperator(op, value.text)
+	if err != nil {
+		return nil, err
+	}
+	return func(b Build) bool { return match(get(b)) }, nil
+}
+
+func compileStringOperator(op filterToken, value string) (func(string) bool, error) {
+	switch op.text {
+	case "==":
+		return func(s string) bool { return s == value }, nil
+	case "!=":
+		return func(s string) bool { return s != value }, nil
+	case "contains":
+		return func(s string) bool { return strings.Contains(s, value) }, nil
+	case "startsWith":
+		return func(s string) bool { return strings.HasPrefix(s, value) }, nil
+	case "endsWith":
+		return func(s string) bool { return strings.HasSuffix(s, value) }, nil
+	case "=~", "!~":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("position %d: %s", op.pos, err)
+		}
+		negate := op.text == "!~"
+		return func(s string) bool { return re.MatchString(s) != negate }, nil
+	default:
+		return nil, fmt.Errorf("position %d: unsupported operator %q for strings", op.pos, op.text)
+	}
+}
+
+func compileNumberComparison(op, value filterToken) (buildFilter, error) {
+	if value.kind != filterNumber {
+		return nil, fmt.Errorf("position %d: number must be compared to a number", value.pos)
+	}
+	n, err := strconv.Atoi(value.text)
+	if err != nil {
+		return nil, fmt.Errorf("position %d: %s", value.pos, err)
+	}
+
+	var cmp func(int) bool
+	switch op.text {
+	case "==":
+		cmp = func(v int) bool { return v == n }
+	case "!=":
+		cmp = func(v int) bool { return v != n }
+	case "<":
+		cmp = func(v int) bool { return v < n }
+	case "<=":
+		cmp = func(v int) bool { return v <= n }
+	case ">":
+		cmp = func(v int) bool { return v > n }
+	case ">=":
+		cmp = func(v int) bool { return v >= n }
+	default:
+		return nil, fmt.Errorf("position %d: unsupported operator %q for numbers", op.pos, op.text)
+	}
+	return func(b Build) bool { return cmp(b.Number) }, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	passed := Build{
+		Number:   42,
+		Pipeline: Pipeline{Name: "backend"},
+		Branch:   "main",
+		State:    "passed",
+		Source:   "webhook",
+		Author:   Person{Name: "Jane", Email: "jane@example.com"},
+		MetaData: map[string]string{"team": "platform"},
+	}
+	dependabot := Build{
+		Number:      7,
+		Pipeline:    Pipeline{Name: "frontend"},
+		Branch:      "dependabot/npm/left-pad",
+		State:       "failed",
+		Source:      "webhook",
+		PullRequest: &PullRequest{ID: "12", Base: "main"},
+	}
+	scheduled := Build{
+		Number:   100,
+		Pipeline: Pipeline{Name: "backend"},
+		Branch:   "main",
+		State:    "failed",
+		Source:   "schedule",
+	}
+	builds := []Build{passed, dependabot, scheduled}
+
+	for _, test := range []struct {
+		filter string
+		// want tells whether each of builds matches.
+		want []bool
+	}{
+		{``, []bool{true, true, true}},
+		{`state == "passed"`, []bool{true, false, false}},
+		{`state != "passed"`, []bool{false, true, true}},
+		{`branch =~ "^dependabot/"`, []bool{false, true, false}},
+		{`branch !~ "^dependabot/"`, []bool{true, false, true}},
+		{`pipeline contains "end"`, []bool{true, true, true}},
+		{`branch startsWith "dependabot/"`, []bool{false, true, false}},
+		{`author.email endsWith "@example.com"`, []bool{true, false, false}},
+		{`pull_request != ""`, []bool{false, true, false}},
+		{`pull_request.base == "main"`, []bool{false, true, false}},
+		{`meta_data.team == "platform"`, []bool{true, false, false}},
+		{`meta_data.missing == ""`, []bool{true, true, true}},
+		{`number == 42`, []bool{true, false, false}},
+		{`number < 42`, []bool{false, true, false}},
+		{`number >= 42`, []bool{true, false, true}},
+
+		// && binds tighter than ||.
+		{`state == "passed" || source == "schedule" && number > 1000`, []bool{true, false, false}},
+		{`(state == "passed" || source == "schedule") && number > 1000`, []bool{false, false, false}},
+		{`source == "schedule" && number > 1000 || state == "passed"`, []bool{true, false, false}},
+
+		// ! applies to the closest condition or parenthesis.
+		{`!state == "passed"`, []bool{false, true, true}},
+		{`!state == "passed" && pipeline == "backend"`, []bool{false, false, true}},
+		{`!(state == "passed" && pipeline == "backend")`, []bool{false, true, true}},
+		{`!!(branch startsWith "dependabot/")`, []bool{false, true, false}},
+		{`source != "schedule" && !(branch startsWith "dependabot/")`, []bool{true, false, false}},
+	} {
+		f, err := parseFilter(test.filter)
+		if err != nil {
+			t.Errorf("parseFilter(%q): %s", test.filter, err)
+			continue
+		}
+		for i, b := range builds {
+			if got := f(b); got != test.want[i] {
+				t.Errorf("parseFilter(%q) for build %d = %v, want %v", test.filter, b.Number, got, test.want[i])
+			}
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		// wantErr is the beginning of the expected error.
+		wantErr string
+	}{
+		{`state`, `position 6: expected an operator, got the end of the filter`},
+		{`state ==`, `position 9: expected a string or number, got the end of the filter`},
+		{`state == passed`, `position 10: expected a string or number, got "passed"`},
+		{`state == "passed`, `position 10: unterminated string`},
+		{`state == "passed" &&`, `position 21: expected a field, ! or (, got the end of the filter`},
+		{`state == "passed" and branch == "main"`, `position 19: expected &&, || or the end of the filter, got "and"`},
+		{`(state == "passed"`, `position 19: expected ), got the end of the filter`},
+		{`state == "passed")`, `position 18: expected &&, || or the end of the filter, got ")"`},
+		{`colour == "red"`, `position 1: unknown field "colour"`},
+		{`state > "passed"`, `position 7: unsupported operator ">" for strings`},
+		{`state == 1`, `position 10: state must be compared to a string`},
+		{`number == "1"`, `position 11: number must be compared to a number`},
+		{`number contains 1`, `position 8: unsupported operator "contains" for numbers`},
+		{`branch =~ "("`, `position 8: error parsing regexp`},
+		{`state == "passed" # comment`, `position 19: unexpected '#'`},
+	} {
+		_, err := parseFilter(test.filter)
+		if err == nil {
+			t.Errorf("parseFilter(%q) succeeded, want error %q", test.filter, test.wantErr)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), test.wantErr) {
+			t.Errorf("parseFilter(%q) = %q, want %q", test.filter, err, test.wantErr)
+		}
+	}
+}
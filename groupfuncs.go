@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// groupFuncs are the functions available in group templates, in addition to
+// the ones built into text/template. Functions taking the value to transform
+// take it last to be usable in pipelines, like
+// {{.Pipeline.Name | replace "-staging$" ""}}.
+var groupFuncs = template.FuncMap{
+	// capture returns the first capture group of the first match of a regexp,
+	// or the whole match if it has no groups. Empty if there is no match.
+	"capture": func(pattern, s string) (string, error) {
+		re, err := groupRegexp(pattern)
+		if err != nil {
+			return "", err
+		}
+		m := re.FindStringSubmatch(s)
+		switch {
+		case m == nil:
+			return "", nil
+		case len(m) > 1:
+			return m[1], nil
+		default:
+			return m[0], nil
+		}
+	},
+
+	// match returns whether a regexp matches.
+	"match": func(pattern, s string) (bool, error) {
+		re, err := groupRegexp(pattern)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(s), nil
+	},
+
+	// replace replaces all matches of a regexp. The replacement can refer to
+	// capture groups using $1.
+	"replace": func(pattern, replacement, s string) (string, error) {
+		re, err := groupRegexp(pattern)
+		if err != nil {
+			return "", err
+		}
+		return re.ReplaceAllString(s, replacement), nil
+	},
+
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+
+	// default returns def if s is empty.
+	"default": func(def, s string) string {
+		if s == "" {
+			return def
+		}
+		return s
+	},
+
+	// hour returns the hour of day, 00-23, in the time zone of the server.
+	"hour": func(t time.Time) string {
+		return fmt.Sprintf("%02d", t.Local().Hour())
+	},
+
+	// weekday returns the day of week, like Monday, in the time zone of the
+	// server.
+	"weekday": func(t time.Time) string {
+		return t.Local().Weekday().String()
+	},
+
+	// duration returns the time between two timestamps, or zero if any of
+	// them is missing.
+	"duration": func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return to.Sub(from)
+	},
+
+	// bucket returns which of the buckets delimited by comma separated,
+	// increasing bounds, like "5m,15m", a duration falls into: "<5m", "5m-15m"
+	// or ">=15m".
+	"bucket": func(spec string, d time.Duration) (string, error) {
+		bounds, durations, err := parseBucketBounds(spec)
+		if err != nil {
+			return "", err
+		}
+		for i, bound := range durations {
+			if d >= bound {
+				continue
+			}
+			if i == 0 {
+				return "<" + bounds[0], nil
+			}
+			return bounds[i-1] + "-" + bounds[i], nil
+		}
+		return ">=" + bounds[len(bounds)-1], nil
+	},
+}
+
+// groupRegexps caches the constant regexps of group templates, compiled when
+// the templates are parsed, since they are executed for every build. Other
+// patterns are compiled per call to not grow the cache with patterns taken
+// from build data.
+var groupRegexps = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+func groupRegexp(pattern string) (*regexp.Regexp, error) {
+	groupRegexps.Lock()
+	re, ok := groupRegexps.m[pattern]
+	groupRegexps.Unlock()
+	if ok {
+		return re, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// cacheGroupRegexp compiles a constant regexp of a group template and adds it
+// to groupRegexps.
+func cacheGroupRegexp(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	groupRegexps.Lock()
+	defer groupRegexps.Unlock()
+	groupRegexps.m[pattern] = re
+	return nil
+}
+
+func parseBucketBounds(spec string) ([]string, []time.Duration, error) {
+	bounds := strings.Split(spec, ",")
+	res := make([]time.Duration, len(bounds))
+	for i, s := range bounds {
+		bounds[i] = strings.TrimSpace(s)
+		d, err := time.ParseDuration(bounds[i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("bucket: %s", err)
+		}
+		if i > 0 && d <= res[i-1] {
+			return nil, nil, fmt.Errorf("bucket: bounds must be increasing, %s is not greater than %s", bounds[i], bounds[i-1])
+		}
+		res[i] = d
+	}
+	return bounds, res, nil
+}
+
+// parseGroup parses a group template. Since builds a template fails for end
+// up in a placeholder group, it is validated as far as possible up front: the
+// constant regexps and bucket bounds given to functions must be valid, and it
+// must execute against an empty Build, or BuildJob for job level reports.
+func parseGroup(s string, jobLevel bool) (*template.Template, error) {
+	t, err := template.New("group").Funcs(groupFuncs).Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateGroupNode(t.Tree.Root); err != nil {
+		return nil, err
+	}
+
+	var v interface{} = Build{}
+	if jobLevel {
+		v = BuildJob{}
+	}
+	if err := t.Execute(ioutil.Discard, v); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func validateGroupNode(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := validateGroupNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return validateGroupNode(n.Pipe)
+	case *parse.IfNode:
+		return validateGroupBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		return validateGroupBranch(&n.BranchNode)
+	case *parse.WithNode:
+		return validateGroupBranch(&n.BranchNode)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Cmds {
+			if err := validateGroupNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		if err := validateGroupCommand(n); err != nil {
+			return err
+		}
+		for _, arg := range n.Args {
+			if err := validateGroupNode(arg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateGroupBranch(n *parse.BranchNode) error {
+	for _, c := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+		if err := validateGroupNode(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateGroupCommand validates the constant arguments of a function call.
+func validateGroupCommand(n *parse.CommandNode) error {
+	ident, ok := n.Args[0].(*parse.IdentifierNode)
+	if !ok {
+		return nil
+	}
+	constant := func(i int) (string, bool) {
+		if i >= len(n.Args) {
+			return "", false
+		}
+		s, ok := n.Args[i].(*parse.StringNode)
+		if !ok {
+			return "", false
+		}
+		return s.Text, true
+	}
+
+	switch ident.Ident {
+	case "capture", "match", "replace":
+		if pattern, ok := constant(1); ok {
+			if err := cacheGroupRegexp(pattern); err != nil {
+				return fmt.Errorf("%s: %s", ident.Ident, err)
+			}
+		}
+	case "bucket":
+		if spec, ok := constant(1); ok {
+			if _, _, err := parseBucketBounds(spec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
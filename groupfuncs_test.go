@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupFuncs(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.Local)
+	build := func(branch string, d time.Duration) Build {
+		return Build{
+			Pipeline:   Pipeline{Name: "backend-staging"},
+			Branch:     branch,
+			CreatedAt:  start,
+			StartedAt:  start,
+			FinishedAt: start.Add(d),
+		}
+	}
+	const buckets = `{{duration .StartedAt .FinishedAt | bucket "5m, 15m"}}`
+
+	for _, test := range []struct {
+		group string
+		build Build
+		want  string
+	}{
+		// capture
+		{`{{.Pipeline.Name | capture "^(.*)-staging$"}}`, build("main", 0), "backend"},
+		{`{{.Branch | capture "[0-9]+"}}`, build("release/42", 0), "42"},
+		{`{{.Branch | capture "^(release)/([0-9]+)$"}}`, build("release/42", 0), "release"},
+		{`{{.Branch | capture "[0-9]+"}}`, build("main", 0), ""},
+
+		// match
+		{`{{if .Branch | match "^dependabot/"}}deps{{else}}other{{end}}`, build("dependabot/npm/x", 0), "deps"},
+		{`{{if .Branch | match "^dependabot/"}}deps{{else}}other{{end}}`, build("main", 0), "other"},
+
+		// replace
+		{`{{.Branch | replace "^feature/(.*)$" "f-$1"}}`, build("feature/login", 0), "f-login"},
+		{`{{.Pipeline.Name | replace "-staging$" ""}}`, build("main", 0), "backend"},
+
+		// lower, upper and default
+		{`{{.Branch | upper}} {{"MAIN" | lower}}`, build("main", 0), "MAIN main"},
+		{`{{.Source | default "unknown"}}`, build("main", 0), "unknown"},
+		{`{{.Branch | default "unknown"}}`, build("main", 0), "main"},
+
+		// hour, weekday and duration
+		{`{{hour .CreatedAt}} {{weekday .CreatedAt}}`, build("main", 0), "09 Friday"},
+		{`{{duration .StartedAt .ScheduledAt}}`, build("main", time.Minute), "0s"},
+
+		// bucket edges
+		{buckets, build("main", 0), "<5m"},
+		{buckets, build("main", 5*time.Minute-time.Second), "<5m"},
+		{buckets, build("main", 5*time.Minute), "5m-15m"},
+		{buckets, build("main", 15*time.Minute-time.Second), "5m-15m"},
+		{buckets, build("main", 15*time.Minute), ">=15m"},
+		{`{{duration .StartedAt .FinishedAt | bucket "1h"}}`, build("main", 2*time.Hour), ">=1h"},
+	} {
+		tmpl, err := parseGroup(test.group, false)
+		if err != nil {
+			t.Errorf("parseGroup(%q): %s", test.group, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, test.build); err != nil {
+			t.Errorf("%q: %s", test.group, err)
+			continue
+		}
+		if buf.String() != test.want {
+			t.Errorf("%q for branch %q = %q, want %q", test.group, test.build.Branch, buf.String(), test.want)
+		}
+	}
+}
+
+func TestParseGroupErrors(t *testing.T) {
+	for _, test := range []struct {
+		group    string
+		jobLevel bool
+		// wantErr is part of the expected error, empty if the group is
+		// valid.
+		wantErr string
+	}{
+		{group: `{{.Branch | capture "("}}`, wantErr: "capture: error parsing regexp"},
+		{group: `{{match "[" .Branch}}`, wantErr: "match: error parsing regexp"},
+		{group: `{{if true}}{{.Branch | replace "(" ""}}{{end}}`, wantErr: "replace: error parsing regexp"},
+		{group: `{{with .Branch}}{{. | capture "("}}{{end}}`, wantErr: "capture: error parsing regexp"},
+		{group: `{{duration .StartedAt .FinishedAt | bucket "15m,5m"}}`, wantErr: "bounds must be increasing"},
+		{group: `{{duration .StartedAt .FinishedAt | bucket "5x"}}`, wantErr: "bucket: "},
+		{group: `{{.Branch | titlecase}}`, wantErr: `function "titlecase" not defined`},
+		{group: `{{.Colour}}`, wantErr: "can't evaluate field Colour"},
+		{group: `{{.Queue}}`, wantErr: "can't evaluate field Queue"},
+		{group: `{{.Queue}}`, jobLevel: true},
+		{group: `{{.Build.Branch}}`, jobLevel: true},
+		// Patterns only known when executing can't be validated up front.
+		{group: `{{capture .Branch "x"}}`},
+	} {
+		_, err := parseGroup(test.group, test.jobLevel)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("parseGroup(%q): %s", test.group, err)
+		case test.wantErr == "":
+		case err == nil:
+			t.Errorf("parseGroup(%q) succeeded, want error %q", test.group, test.wantErr)
+		case !strings.Contains(err.Error(), test.wantErr):
+			t.Errorf("parseGroup(%q) = %q, want %q", test.group, err, test.wantErr)
+		}
+	}
+}
+
+func TestGroupRegexpsCachesOnlyConstants(t *testing.T) {
+	tmpl, err := parseGroup(`{{capture .Branch .Pipeline.Name}}{{.Branch | match "^constant-pattern$"}}`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := Build{Pipeline: Pipeline{Name: "pipeline-pattern"}, Branch: "branch-pattern"}
+	if err := tmpl.Execute(&bytes.Buffer{}, b); err != nil {
+		t.Fatal(err)
+	}
+
+	groupRegexps.Lock()
+	defer groupRegexps.Unlock()
+	if _, ok := groupRegexps.m["^constant-pattern$"]; !ok {
+		t.Error("constant pattern was not cached")
+	}
+	if _, ok := groupRegexps.m[b.Branch]; ok {
+		t.Error("pattern from build data was cached")
+	}
+}
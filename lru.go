@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// BuildLRU is a size bounded, in-process cache of decoded builds per interval.
+// It sits in front of the Cache of NetworkBuildkite to not round-trip to it,
+// and decompress and decode the same builds, on every page load.
+type BuildLRU struct {
+	maxBytes int64
+	maxAge   time.Duration
+
+	mutex sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	bytes int64
+}
+
+type lruEntry struct {
+	key     string
+	builds  []Build
+	size    int64
+	expires time.Time
+}
+
+// NewBuildLRU creates a cache holding at most maxBytes of builds, as
+// estimated by memorySize. Entries are kept at most maxAge to pick up changes
+// written to the Cache by other processes, such as the refresh command.
+func NewBuildLRU(maxBytes int64, maxAge time.Duration) *BuildLRU {
+	return &BuildLRU{
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *BuildLRU) Get(key string) ([]Build, bool) {
+	builds, ok := c.lookup(key)
+	if ok {
+		localCacheRequests.Inc("hit")
+	} else {
+		localCacheRequests.Inc("miss")
+	}
+	return builds, ok
+}
+
+// lookup is Get without counting the request. Used to check again for
+// entries added while waiting for a concurrent fetch, which would otherwise
+// count the same miss twice.
+func (c *BuildLRU) lookup(key string) ([]Build, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		localCacheEvictions.Inc("expired")
+		return nil, false
+	}
+
+	c.ll.MoveToFront(e)
+	return entry.builds, true
+}
+
+// Put adds builds to the cache. The builds must not be modified afterwards.
+func (c *BuildLRU) Put(key string, builds []Build, ttl time.Duration) {
+	if ttl > c.maxAge {
+		ttl = c.maxAge
+	}
+	entry := &lruEntry{
+		key:     key,
+		builds:  builds,
+		size:    buildsMemorySize(builds),
+		expires: time.Now().Add(ttl),
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	if entry.size > c.maxBytes {
+		// Would evict everything else and still not fit.
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(entry)
+	c.bytes += entry.size
+	for c.bytes > c.maxBytes {
+		c.remove(c.ll.Back())
+		localCacheEvictions.Inc("size")
+	}
+	c.updateGauges()
+}
+
+func (c *BuildLRU) remove(e *list.Element) {
+	entry := c.ll.Remove(e).(*lruEntry)
+	delete(c.items, entry.key)
+	c.bytes -= entry.size
+	c.updateGauges()
+}
+
+func (c *BuildLRU) updateGauges() {
+	localCacheBytes.Set(float64(c.bytes))
+	localCacheEntries.Set(float64(c.ll.Len()))
+}
+
+// buildsMemorySize estimates how much memory builds occupy.
+func buildsMemorySize(builds []Build) int64 {
+	size := int64(unsafe.Sizeof(builds))
+	for _, b := range builds {
+		size += int64(unsafe.Sizeof(b)) + int64(len(b.ID)+len(b.Org)+len(b.Pipeline.Name)+len(b.Branch)+len(b.State))
+		size += int64(len(b.WebURL) + len(b.Commit) + len(b.Message) + len(b.Source))
+		size += int64(len(b.Creator.Name) + len(b.Creator.Email) + len(b.Author.Name) + len(b.Author.Email))
+		if pr := b.PullRequest; pr != nil {
+			size += int64(unsafe.Sizeof(*pr)) + int64(len(pr.ID)+len(pr.Base)+len(pr.Repository))
+		}
+		for k, v := range b.MetaData {
+			size += int64(len(k) + len(v))
+		}
+		for _, j := range b.Jobs {
+			size += int64(unsafe.Sizeof(j)) + int64(len(j.StepKey)+len(j.Label)+len(j.Queue)+len(j.State)+len(j.AgentID)+len(j.AgentName))
+			if j.ExitStatus != nil {
+				size += int64(unsafe.Sizeof(*j.ExitStatus))
+			}
+		}
+	}
+	return size
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// counterValue returns the current value of c for labelValue.
+func counterValue(c *counterVec, labelValue string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[labelValue]
+}
+
+// assertLRUSize checks the entries and bytes held by c, and that the gauges
+// agree.
+func assertLRUSize(t *testing.T, c *BuildLRU, entries int, bytes int64) {
+	t.Helper()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ll.Len() != entries || len(c.items) != entries || c.bytes != bytes {
+		t.Errorf("cache holds %d entries (%d indexed) of %d bytes, want %d entries of %d bytes", c.ll.Len(), len(c.items), c.bytes, entries, bytes)
+	}
+	if localCacheEntries.value != float64(entries) || localCacheBytes.value != float64(bytes) {
+		t.Errorf("gauges report %v entries of %v bytes, want %d entries of %d bytes", localCacheEntries.value, localCacheBytes.value, entries, bytes)
+	}
+}
+
+func testBuilds(id string) []Build {
+	return []Build{{ID: id, Pipeline: Pipeline{Name: "pipeline"}, Jobs: []Job{{Label: "test"}}}}
+}
+
+func TestBuildLRUCapsTTLAtMaxAge(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		ttl     time.Duration
+		wantTTL time.Duration
+	}{
+		{"shorter than max age", time.Minute, time.Minute},
+		{"longer than max age", 24 * time.Hour, time.Hour},
+	} {
+		c := NewBuildLRU(1<<20, time.Hour)
+		before := time.Now()
+		c.Put("a", testBuilds("a"), test.ttl)
+		after := time.Now()
+
+		expires := c.items["a"].Value.(*lruEntry).expires
+		if expires.Before(before.Add(test.wantTTL)) || expires.After(after.Add(test.wantTTL)) {
+			t.Errorf("%s: entry expires in %s, want %s", test.name, expires.Sub(before), test.wantTTL)
+		}
+	}
+}
+
+func TestBuildLRUExpiry(t *testing.T) {
+	c := NewBuildLRU(1<<20, time.Hour)
+	c.Put("expired", testBuilds("expired"), -time.Second)
+	c.Put("fresh", testBuilds("fresh"), time.Minute)
+	size := buildsMemorySize(testBuilds("fresh"))
+
+	expired := counterValue(localCacheEvictions, "expired")
+	if _, ok := c.lookup("expired"); ok {
+		t.Error("lookup() returned an expired entry")
+	}
+	if got := counterValue(localCacheEvictions, "expired") - expired; got != 1 {
+		t.Errorf("counted %v expired evictions, want 1", got)
+	}
+	assertLRUSize(t, c, 1, size)
+
+	if _, ok := c.lookup("fresh"); !ok {
+		t.Error("lookup() did not return a fresh entry")
+	}
+}
+
+func TestBuildLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	size := buildsMemorySize(testBuilds("a"))
+
+	for _, test := range []struct {
+		name string
+		// get is looked up between adding the first two entries and the
+		// third.
+		get         string
+		wantEvicted string
+	}{
+		{"oldest", "", "a"},
+		{"least recently used", "a", "b"},
+	} {
+		c := NewBuildLRU(2*size+size/2, time.Hour)
+		evictions := counterValue(localCacheEvictions, "size")
+
+		c.Put("a", testBuilds("a"), time.Hour)
+		c.Put("b", testBuilds("b"), time.Hour)
+		if test.get != "" {
+			c.Get(test.get)
+		}
+		c.Put("c", testBuilds("c"), time.Hour)
+
+		if got := counterValue(localCacheEvictions, "size") - evictions; got != 1 {
+			t.Errorf("%s: counted %v size evictions, want 1", test.name, got)
+		}
+		for _, key := range []string{"a", "b", "c"} {
+			if _, ok := c.lookup(key); ok == (key == test.wantEvicted) {
+				t.Errorf("%s: lookup(%q) = %v", test.name, key, ok)
+			}
+		}
+		assertLRUSize(t, c, 2, 2*size)
+	}
+}
+
+func TestBuildLRUSkipsOversizedEntries(t *testing.T) {
+	size := buildsMemorySize(testBuilds("a"))
+	c := NewBuildLRU(size, time.Hour)
+	c.Put("a", testBuilds("a"), time.Hour)
+
+	big := append(testBuilds("b"), testBuilds("c")...)
+	c.Put("b", big, time.Hour)
+	if _, ok := c.lookup("b"); ok {
+		t.Error("an entry larger than the cache was added")
+	}
+	if _, ok := c.lookup("a"); !ok {
+		t.Error("an entry was evicted for one which does not fit")
+	}
+	assertLRUSize(t, c, 1, size)
+
+	// Replacing an entry with one that does not fit removes it.
+	c.Put("a", big, time.Hour)
+	assertLRUSize(t, c, 0, 0)
+}
+
+func TestBuildLRURequestCounting(t *testing.T) {
+	c := NewBuildLRU(1<<20, time.Hour)
+	c.Put("a", testBuilds("a"), time.Hour)
+
+	for _, test := range []struct {
+		name              string
+		get               func(key string) ([]Build, bool)
+		key               string
+		wantHit, wantMiss float64
+	}{
+		{"Get hit", c.Get, "a", 1, 0},
+		{"Get miss", c.Get, "b", 0, 1},
+		{"lookup hit", c.lookup, "a", 0, 0},
+		{"lookup miss", c.lookup, "b", 0, 0},
+	} {
+		hits, misses := counterValue(localCacheRequests, "hit"), counterValue(localCacheRequests, "miss")
+		test.get(test.key)
+		if got := counterValue(localCacheRequests, "hit") - hits; got != test.wantHit {
+			t.Errorf("%s: counted %v hits, want %v", test.name, got, test.wantHit)
+		}
+		if got := counterValue(localCacheRequests, "miss") - misses; got != test.wantMiss {
+			t.Errorf("%s: counted %v misses, want %v", test.name, got, test.wantMiss)
+		}
+	}
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -20,55 +22,152 @@ import (
 )
 
 var (
-	apiToken       = kingpin.Flag("buildkite-token", "Buildkite API token. Requires `read_builds` permissions.").Required().String()
-	org            = kingpin.Flag("buildkite-org", "Buildkite organization which is to be scraped.").Required().String()
-	port           = kingpin.Flag("port", "TCP port which the HTTP server should listen on.").Default("8080").Int()
-	memcachedAddrs = kingpin.Flag("memcache", "Memcache broker addresses (eg. 127.0.0.1:11211).").Strings()
+	configFile         = kingpin.Flag("config", "JSON or YAML (.yaml/.yml) file with the organization, cache settings, scrape history and reports. Flags take precedence over it.").String()
+	configPollInterval = kingpin.Flag("config-poll-interval", "How often to check whether --config has changed to reload its reports. 0 disables polling. Reports are also reloaded on SIGHUP.").Default("30s").Duration()
+	apiToken           = kingpin.Flag("buildkite-token", "Buildkite API token. Requires `read_builds` permissions. Required unless given by --config.").String()
+	org                = kingpin.Flag("buildkite-org", "Buildkite organization which is to be scraped. Required unless given by --config, which also can list several organizations.").String()
+	port               = kingpin.Flag("port", "TCP port which the HTTP server should listen on.").Default("8080").Int()
+	memcachedAddrs     = kingpin.Flag("memcache", "Memcache broker addresses (eg. 127.0.0.1:11211).").Strings()
+
+	cacheBackend            = kingpin.Flag("cache", "Where to cache builds. Either memcache (see --memcache) or disk (see --cache-file).").Default("memcache").Enum("memcache", "disk")
+	cacheFile               = kingpin.Flag("cache-file", "File to cache builds in when using the disk cache. Locked by the process using it, so it can't be shared with other processes or the refresh command.").Default("buildkite-stats.cache").String()
+	localCacheSize          = kingpin.Flag("local-cache-size", "Maximum estimated memory used by the in-process cache of builds in front of --cache. 0 disables it.").Default("256MB").Bytes()
+	localCacheMaxAge        = kingpin.Flag("local-cache-max-age", "For how long builds are kept in the in-process cache before being read from --cache again. Changes made by the refresh command are picked up after this.").Default("10m").Duration()
+	cacheCompactionInterval = kingpin.Flag("cache-compaction-interval", "How often to check whether the disk cache file needs to be compacted.").Default("1h").Duration()
 
 	serveCmd      = kingpin.Command("serve", "serve the the web app.")
-	reports       = serveCmd.Flag("report", `Report. Example: {"name": "Slow master builds", "from": "started", "to": "finished", "pipelines": ".*", "branches: "master", "group": "{{.Pipeline}}"} where 1) 'from'/'to' must be created, scheduled, started or finished, 2) 'pipelines'/'branches' is a regexp of what we are interested in, 3) name can be anything human readable, 4) 'group' is how all builds are grouped (a Golang template from Build).`).Required().Strings()
+	reports       = serveCmd.Flag("report", `Report. Example: {"name": "Slow master builds", "from": "started", "to": "finished", "pipelines": ".*", "branches: "master", "group": "{{.Pipeline}}", "states": ["passed"]} where 1) 'from'/'to' must be created, scheduled, started or finished, 2) 'pipelines'/'branches' is a regexp of what we are interested in, 3) name can be anything human readable, 4) 'group' is how all builds are grouped (a Golang template from Build, with the functions listed in the README), 5) 'states' is an optional list of build states to include (passed, failed, canceled, blocked, skipped or not_run). Defaults to only passed builds, 6) 'level' is optionally 'job' to measure individual jobs instead of builds, which also allows 'runnable' as 'from'/'to' and a 'queues' regexp. The group is then executed against a BuildJob. Example measuring agent queue wait: {"name": "Queue wait", "level": "job", "from": "runnable", "to": "started", "pipelines": ".*", "branches": ".*", "group": "{{.Queue}}"}, 7) 'id' optionally identifies the report in URLs (a-z, 0-9, - and _). Defaults to a slug of the name, 8) 'filter' is an optional expression builds must match, like 'source != "schedule" && !(branch startsWith "dependabot/")'. See the README. Required unless reports are given by --config, whose reports are ignored if this is given.`).Strings()
 	scrapeHistory = serveCmd.Flag("scrape-history", "How far back in time we scrape builds. Defaults to 28 days.").Default("672h").Duration()
+	maxHistory    = serveCmd.Flag("max-history", "How far back in time periods chosen using the from and baseline_from query parameters can start. Builds older than --scrape-history are fetched from Buildkite on demand. Defaults to twice --scrape-history, to be able to compare to the preceding period.").Duration()
 
-	refreshCmd     = kingpin.Command("refresh", "rewrite recent data to cache. recommended to do in background regularly if you have a lot of builds.")
+	metricsWindows   = serveCmd.Flag("metrics-window", "Rolling window over which report metrics are exposed on /metrics. Can be repeated.").Default("24h", "168h").DurationList()
+	metricsQuantiles = serveCmd.Flag("metrics-quantile", "Duration quantile, between 0 and 1, exposed for every report group on /metrics. Can be repeated.").Default("0.5", "0.9", "0.99").Float64List()
+
+	regressionInterval = serveCmd.Flag("regression-interval", "How often to look for step changes in the build times of every report group during --scrape-history, listed on /regressions. 0 disables it.").Default("1h").Duration()
+
+	refreshCmd     = kingpin.Command("refresh", "rewrite recent data to cache. recommended to do in background regularly if you have a lot of builds. requires --cache=memcache.")
 	refreshHistory = refreshCmd.Flag("refresh-history", "How far back in time we update the cache.").Default("3h").Duration()
 )
 
 func main() {
 	cmd := kingpin.Parse()
 
-	//buildkite.SetHttpDebug(true) // Useful when debugging.
-	config, err := buildkite.NewTokenConfig(optionalFileExpansion(*apiToken), false)
-
-	if err != nil {
-		log.Fatal("Incorrect token:", err)
+	var cfg Config
+	if *configFile != "" {
+		var err error
+		if cfg, err = loadConfig(*configFile); err != nil {
+			log.Fatalf("unable to load config %s: %s", *configFile, err)
+		}
+		applyConfig(cfg)
+	}
+	orgs := configuredOrgs(cfg)
+	if len(orgs) == 0 {
+		kingpin.Fatalf("required flag --buildkite-org not provided")
+	}
+	for _, o := range orgs {
+		if o.Token == "" {
+			kingpin.Fatalf("required flag --buildkite-token not provided for org %s", o.Name)
+		}
 	}
 
-	cache := &MemcacheCache{memcache.New(*memcachedAddrs...)}
+	if cmd == "refresh" && *cacheBackend == "disk" {
+		// The cache file is locked by serve, which wouldn't see the
+		// refreshed builds anyway since it only reads the file when started.
+		kingpin.Fatalf("refresh requires --cache=memcache since the disk cache can't be shared with serve")
+	}
 
-	queries := mustBuildQueries(*reports)
+	cache := mustBuildCache()
+	var local *BuildLRU
+	if *localCacheSize > 0 {
+		local = NewBuildLRU(int64(*localCacheSize), *localCacheMaxAge)
+	}
 
-	client := buildkite.NewClient(config.Client())
-	client.UserAgent = "tink-buildkite-stats/v1.0.0"
-	bk := &NetworkBuildkite{
-		Client: client,
-		Org:    *org,
-		Cache:  cache,
+	var bk MultiOrgBuildkite
+	for _, o := range orgs {
+		//buildkite.SetHttpDebug(true) // Useful when debugging.
+		config, err := buildkite.NewTokenConfig(optionalFileExpansion(o.Token), false)
+		if err != nil {
+			log.Fatalf("Incorrect token for %s: %s", o.Name, err)
+		}
+
+		// Buildkite's rate limit is per organization.
+		httpClient := config.Client()
+		httpClient.Transport = &RateLimitedTransport{Transport: httpClient.Transport, Org: o.Name}
+		client := buildkite.NewClient(httpClient)
+		client.UserAgent = "tink-buildkite-stats/v1.0.0"
+		bk = append(bk, &NetworkBuildkite{
+			Client: client,
+			Org:    o.Name,
+			Cache:  cache,
+			Local:  local,
+		})
 	}
 
 	switch cmd {
 	case "serve":
-		serve(bk, queries)
+		serve(bk, cfg, mustBuildQueries(cfg))
 	case "refresh":
 		refresh(bk)
 	}
 }
 
-func serve(bk *NetworkBuildkite, queries []Query) {
+// configuredOrgs returns the organizations to scrape. --buildkite-org, or org
+// in the config file, takes precedence over orgs in the config file.
+func configuredOrgs(cfg Config) []OrgConfig {
+	if *org != "" {
+		return []OrgConfig{{Name: *org, Token: *apiToken}}
+	}
+	var res []OrgConfig
+	for _, o := range cfg.Orgs {
+		if o.Token == "" {
+			o.Token = *apiToken
+		}
+		res = append(res, o)
+	}
+	return res
+}
+
+func serve(bk Buildkite, cfg Config, queries []Query) {
+	for _, q := range *metricsQuantiles {
+		if q < 0 || q > 1 {
+			kingpin.Fatalf("--metrics-quantile must be between 0 and 1, got %v", q)
+		}
+	}
+	if *maxHistory == 0 {
+		*maxHistory = 2 * *scrapeHistory
+	}
+	if *maxHistory < *scrapeHistory {
+		kingpin.Fatalf("--max-history must be at least --scrape-history")
+	}
+
+	current := NewReports(queries)
+	go current.ReloadOnChange(*configFile, *configPollInterval, func() ([]Query, string, error) {
+		return reloadQueries(cfg)
+	})
+
+	var detector *RegressionDetector
+	if *regressionInterval > 0 {
+		detector = &RegressionDetector{
+			Buildkite: bk,
+			Reports:   current,
+			History:   *scrapeHistory,
+		}
+		go detector.Run(*regressionInterval)
+	}
+
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.DefaultLogger)
-	r.Mount("/", (&Routes{bk, queries, *scrapeHistory}).Routes())
+	r.Mount("/", (&Routes{
+		Buildkite:        bk,
+		Reports:          current,
+		ScrapeHistory:    *scrapeHistory,
+		MaxHistory:       *maxHistory,
+		MetricsWindows:   *metricsWindows,
+		MetricsQuantiles: *metricsQuantiles,
+		Regressions:      detector,
+	}).Routes())
 
 	go func() {
 		// pprof registers on default mux so starting it on a separate port.
@@ -83,7 +182,7 @@ func serve(bk *NetworkBuildkite, queries []Query) {
 	}
 }
 
-func refresh(bk *NetworkBuildkite) {
+func refresh(bk Buildkite) {
 	from := time.Now().Add(-*refreshHistory)
 	log.Printf("Starting refresh between [%s, now)\n", from)
 	if err := bk.RefreshCache(from); err != nil {
@@ -92,6 +191,20 @@ func refresh(bk *NetworkBuildkite) {
 	log.Println("Refresh finished succesfully.")
 }
 
+func mustBuildCache() Cache {
+	switch *cacheBackend {
+	case "disk":
+		c, err := OpenDiskCache(*cacheFile)
+		if err != nil {
+			log.Fatalln("unable to open cache file:", err)
+		}
+		go c.CompactEvery(*cacheCompactionInterval)
+		return c
+	default:
+		return &MemcacheCache{memcache.New(*memcachedAddrs...)}
+	}
+}
+
 type MemcacheCache struct {
 	c *memcache.Client
 }
@@ -113,59 +226,316 @@ func (m *MemcacheCache) Get(k string) ([]byte, error) {
 	return res, err
 }
 
-func mustBuildQueries(queries []string) (res []Query) {
-	for _, q := range queries {
-		res = append(res, mustBuildQuery(q))
+func mustBuildQueries(cfg Config) []Query {
+	if len(*reports) == 0 && len(cfg.Reports) == 0 {
+		kingpin.Fatalf("required flag --report not provided")
+	}
+	queries, err := loadQueries(cfg)
+	if err != nil {
+		log.Fatalln("invalid report:", err)
+	}
+	return queries
+}
+
+// loadQueries builds the reports given by --report, or by the config file if
+// there are none.
+func loadQueries(cfg Config) ([]Query, error) {
+	raws := cfg.Reports
+	if len(*reports) > 0 {
+		var err error
+		if raws, err = parseReports(*reports); err != nil {
+			return nil, err
+		}
 	}
-	return
+	if len(raws) == 0 {
+		return nil, errors.New("no reports given by --report or --config")
+	}
+	return buildQueries(raws)
 }
 
-func mustBuildQuery(query string) Query {
-	var raw JSONQuery
-	if err := json.Unmarshal([]byte(query), &raw); err != nil {
-		log.Fatalln("unable to parse report:", err)
+// reloadQueries rereads the config file, if any, and builds the reports. The
+// warning lists the settings that changed since started was loaded, which
+// are only read at start.
+func reloadQueries(started Config) ([]Query, string, error) {
+	var cfg Config
+	if *configFile != "" {
+		var err error
+		if cfg, err = loadConfig(*configFile); err != nil {
+			return nil, "", fmt.Errorf("unable to load config %s: %s", *configFile, err)
+		}
+	}
+	queries, err := loadQueries(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var warning string
+	if changed := changedStartupSettings(started, cfg); len(changed) > 0 {
+		warning = fmt.Sprintf("Changes of %s are ignored until restarted.", strings.Join(changed, ", "))
 	}
+	return queries, warning, nil
+}
 
-	return Query{
-		Name:      raw.Name,
-		from:      mustParseQueryTimestamp(raw.From),
-		to:        mustParseQueryTimestamp(raw.To),
-		pipelines: regexp.MustCompile(raw.Pipelines),
-		branches:  regexp.MustCompile(raw.Branches),
-		group:     template.Must(template.New("group").Parse(raw.Group)),
+// parseReports parses the JSON reports given by --report.
+func parseReports(reports []string) ([]JSONQuery, error) {
+	var res []JSONQuery
+	for i, report := range reports {
+		var raw JSONQuery
+		if err := json.Unmarshal([]byte(report), &raw); err != nil {
+			return nil, fmt.Errorf("report %d: %s", i+1, err)
+		}
+		res = append(res, raw)
 	}
+	return res, nil
+}
+
+// buildQueries validates all reports. Errors point out the offending report.
+func buildQueries(raws []JSONQuery) ([]Query, error) {
+	var res []Query
+	ids := make(map[string]bool)
+	for i, raw := range raws {
+		q, err := buildQuery(raw)
+		if err == nil && ids[q.ID] {
+			err = fmt.Errorf("id: %q is used by another report, set a unique id", q.ID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("report %d (%q): %s", i+1, raw.Name, err)
+		}
+		ids[q.ID] = true
+		res = append(res, q)
+	}
+	return res, nil
+}
+
+func buildQuery(raw JSONQuery) (Query, error) {
+	var err error
+	q := Query{Name: raw.Name}
+	if q.ID, err = parseReportID(raw); err != nil {
+		return q, fmt.Errorf("id: %s", err)
+	}
+	if q.from, err = parseQueryTimestamp(raw.From); err != nil {
+		return q, fmt.Errorf("from: %s", err)
+	}
+	if q.to, err = parseQueryTimestamp(raw.To); err != nil {
+		return q, fmt.Errorf("to: %s", err)
+	}
+	if q.pipelines, err = regexp.Compile(raw.Pipelines); err != nil {
+		return q, fmt.Errorf("pipelines: %s", err)
+	}
+	if q.branches, err = regexp.Compile(raw.Branches); err != nil {
+		return q, fmt.Errorf("branches: %s", err)
+	}
+	if q.states, err = parseStates(raw.States); err != nil {
+		return q, fmt.Errorf("states: %s", err)
+	}
+	if q.jobs, err = parseLevel(raw.Level); err != nil {
+		return q, fmt.Errorf("level: %s", err)
+	}
+	if q.group, err = parseGroup(raw.Group, q.jobs); err != nil {
+		return q, fmt.Errorf("group: %s", err)
+	}
+	if q.queues, err = regexp.Compile(raw.Queues); err != nil {
+		return q, fmt.Errorf("queues: %s", err)
+	}
+	if q.filter, err = parseFilter(raw.Filter); err != nil {
+		return q, fmt.Errorf("filter: %s", err)
+	}
+	if !q.jobs && (q.from == RunnableTimestamp || q.to == RunnableTimestamp) {
+		return q, errors.New("the runnable timestamp requires a job level report")
+	}
+	return q, nil
+}
+
+var (
+	reportIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	nonSlugPattern  = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// reservedReportIDs are the top level paths of pages that aren't reports.
+var reservedReportIDs = map[string]bool{
+	"agents":      true,
+	"api":         true,
+	"metrics":     true,
+	"ping":        true,
+	"regressions": true,
+	"status":      true,
+}
+
+// parseReportID returns the id of a report. Defaults to a slug of its name.
+func parseReportID(raw JSONQuery) (string, error) {
+	id := raw.ID
+	if id == "" {
+		id = strings.Trim(nonSlugPattern.ReplaceAllString(strings.ToLower(raw.Name), "-"), "-")
+		if id == "" {
+			return "", errors.New("missing, set an id or a name")
+		}
+	}
+
+	var err error
+	switch _, atoiErr := strconv.Atoi(id); {
+	case !reportIDPattern.MatchString(id):
+		err = fmt.Errorf("%q must only contain a-z, 0-9, - and _", id)
+	case atoiErr == nil:
+		// Would be mistaken for the index of a report.
+		err = fmt.Errorf("%q must not be a number", id)
+	case reservedReportIDs[id]:
+		err = fmt.Errorf("%q is reserved", id)
+	}
+	if err != nil && raw.ID == "" {
+		err = fmt.Errorf("%s. It was derived from the name, set an id", err)
+	}
+	return id, err
+}
+
+// parseLevel returns true for job level reports.
+func parseLevel(s string) (bool, error) {
+	switch s {
+	case "", "build":
+		return false, nil
+	case "job":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unrecognized report level %q", s)
+	}
+}
+
+func parseStates(states []string) (map[string]bool, error) {
+	if len(states) == 0 {
+		// Backwards compatible default from when we only fetched passed
+		// builds.
+		states = []string{"passed"}
+	}
+
+	res := make(map[string]bool)
+	for _, s := range states {
+		if !isFinishedState(s) {
+			return nil, fmt.Errorf("unrecognized build state %q", s)
+		}
+		res[s] = true
+	}
+	return res, nil
 }
 
 type JSONQuery struct {
-	Name      string `json:"name"`
-	From      string `json:"from"`
-	To        string `json:"to"`
-	Pipelines string `json:"pipelines"`
-	Branches  string `json:"branches"`
-	Group     string `json:"group"`
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Pipelines string   `json:"pipelines"`
+	Branches  string   `json:"branches"`
+	Group     string   `json:"group"`
+	States    []string `json:"states"`
+	Level     string   `json:"level"`
+	Queues    string   `json:"queues"`
+	Filter    string   `json:"filter"`
 }
 
 type Query struct {
+	// ID identifies the report in URLs.
+	ID        string
 	Name      string
 	from      QueryTimestamp
 	to        QueryTimestamp
 	pipelines *regexp.Regexp
 	branches  *regexp.Regexp
 	group     *template.Template
+	states    map[string]bool
+
+	// filter is a filter expression that builds must match in addition to
+	// the pipelines and branches regexps.
+	filter buildFilter
+
+	// jobs is true for job level reports, which measure individual jobs
+	// instead of whole builds.
+	jobs   bool
+	queues *regexp.Regexp
+}
+
+// BuildJob is what the group template of a job level report is executed
+// against.
+type BuildJob struct {
+	Job
+	Build Build
+}
+
+// Sample is a single duration measured by a Query. Build level reports have
+// one sample per build while job level reports have one per job.
+type Sample struct {
+	Group string
+
+	// When is the from timestamp of the query.
+	When     time.Time
+	Duration time.Duration
+}
+
+// JobLevel returns true if the query measures jobs instead of builds.
+func (q Query) JobLevel() bool {
+	return q.jobs
+}
+
+// Samples returns the samples of a build. Builds and jobs that are missing any
+// of the timestamps of the query are skipped.
+func (q Query) Samples(b Build) []Sample {
+	if !q.jobs {
+		d, ok := q.Duration(b)
+		if !ok {
+			return nil
+		}
+		return []Sample{{q.Group(b), q.from.Extract(b), d}}
+	}
+
+	var res []Sample
+	for _, j := range b.Jobs {
+		if !q.queues.MatchString(j.Queue) {
+			continue
+		}
+		from, to := q.from.ExtractJob(j), q.to.ExtractJob(j)
+		if from.IsZero() || to.IsZero() {
+			continue
+		}
+		res = append(res, Sample{q.execGroup(BuildJob{j, b}), from, to.Sub(from)})
+	}
+	return res
 }
 
 func (q Query) Predicate(b Build) bool {
-	return q.pipelines.MatchString(b.Pipeline.Name) && q.branches.MatchString(b.Branch)
+	return q.states[b.State] && q.MatchesIgnoringState(b)
 }
 
-func (q Query) Duration(b Build) time.Duration {
-	return q.to.Extract(b).Sub(q.from.Extract(b))
+// MatchesIgnoringState is like Predicate, but ignores the states of the query.
+// Useful for reports that compare builds in different states. Note that the
+// filter still applies, including any conditions on the state.
+func (q Query) MatchesIgnoringState(b Build) bool {
+	return q.pipelines.MatchString(b.Pipeline.Name) && q.branches.MatchString(b.Branch) && q.filter(b)
 }
 
+// Duration returns the time between the from and to timestamps of the query.
+// The second return value is false if the build is missing any of them, which
+// is the case for builds that never started.
+func (q Query) Duration(b Build) (time.Duration, bool) {
+	from, to := q.from.Extract(b), q.to.Extract(b)
+	if from.IsZero() || to.IsZero() {
+		return 0, false
+	}
+	return to.Sub(from), true
+}
+
+// Group returns the group of a build. Must not be called for job level
+// queries.
 func (q Query) Group(b Build) string {
+	return q.execGroup(b)
+}
+
+// groupErrorPlaceholder is the group of builds whose group template failed.
+// parseGroup can't catch every failure, like a regexp taken from a field of
+// the build being invalid.
+const groupErrorPlaceholder = "(group error)"
+
+func (q Query) execGroup(v interface{}) string {
 	var buf bytes.Buffer
-	if err := q.group.Execute(&buf, b); err != nil {
-		log.Panicln("extract the build group:", err)
+	if err := q.group.Execute(&buf, v); err != nil {
+		groupErrors.Inc(q.ID)
+		return groupErrorPlaceholder
 	}
 	return string(buf.Bytes())
 }
@@ -177,24 +547,43 @@ const (
 	ScheduledTimestamp
 	StartedTimestamp
 	FinishedTimestamp
+
+	// RunnableTimestamp is only available for jobs.
+	RunnableTimestamp
 )
 
-func mustParseQueryTimestamp(s string) QueryTimestamp {
+func parseQueryTimestamp(s string) (QueryTimestamp, error) {
 	switch s {
 	case "created":
-		return CreatedTimestamp
+		return CreatedTimestamp, nil
 	case "scheduled":
-		return ScheduledTimestamp
+		return ScheduledTimestamp, nil
 	case "started":
-		return StartedTimestamp
+		return StartedTimestamp, nil
 	case "finished":
-		return FinishedTimestamp
+		return FinishedTimestamp, nil
+	case "runnable":
+		return RunnableTimestamp, nil
 	default:
-		log.Fatalln("unable to parse timestamp")
+		return 0, fmt.Errorf("unrecognized timestamp %q", s)
 	}
+}
 
-	// will never happen
-	return 0
+func (t QueryTimestamp) String() string {
+	switch t {
+	case CreatedTimestamp:
+		return "created"
+	case ScheduledTimestamp:
+		return "scheduled"
+	case StartedTimestamp:
+		return "started"
+	case FinishedTimestamp:
+		return "finished"
+	case RunnableTimestamp:
+		return "runnable"
+	default:
+		return fmt.Sprintf("QueryTimestamp(%d)", int(t))
+	}
 }
 
 func (t QueryTimestamp) Extract(b Build) time.Time {
@@ -215,6 +604,26 @@ func (t QueryTimestamp) Extract(b Build) time.Time {
 	return time.Now()
 }
 
+func (t QueryTimestamp) ExtractJob(j Job) time.Time {
+	switch t {
+	case CreatedTimestamp:
+		return j.CreatedAt
+	case ScheduledTimestamp:
+		return j.ScheduledAt
+	case RunnableTimestamp:
+		return j.RunnableAt
+	case StartedTimestamp:
+		return j.StartedAt
+	case FinishedTimestamp:
+		return j.FinishedAt
+	default:
+		log.Panicln("unrecognized timestamp type:", t)
+	}
+
+	// will never happen
+	return time.Now()
+}
+
 func optionalFileExpansion(s string) string {
 	if strings.HasPrefix(s, "@") {
 		// Trimming trailing newline from K8s configmap.
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains a minimal implementation of the Prometheus text
+// exposition format. We only have a handful of metrics, which doesn't warrant
+// pulling in the full client library.
+
+// Process level metrics.
+var (
+	cacheRequests       = newCounterVec("buildkite_stats_cache_requests_total", "Cache lookups of hourly build intervals. Undecodable entries are refetched like misses.", "result")
+	apiRequests         = newCounterVec("buildkite_stats_buildkite_requests_total", "Requests made to the Buildkite API.", "result")
+	apiRetries          = newCounterVec("buildkite_stats_buildkite_retries_total", "Retried requests to the Buildkite API.", "reason")
+	throttledSeconds    = newCounterVec("buildkite_stats_buildkite_throttled_seconds_total", "Time spent waiting before requesting the Buildkite API.", "reason")
+	rateLimitRemaining  = newGaugeVec("buildkite_stats_buildkite_rate_limit_remaining", "Remaining requests of the Buildkite rate limit of an organization, as last reported by Buildkite.", "org")
+	localCacheRequests  = newCounterVec("buildkite_stats_local_cache_requests_total", "In-process cache lookups of hourly build intervals.", "result")
+	localCacheEvictions = newCounterVec("buildkite_stats_local_cache_evictions_total", "Intervals evicted from the in-process cache.", "reason")
+	localCacheBytes     = newGauge("buildkite_stats_local_cache_bytes", "Estimated memory used by the in-process cache.")
+	localCacheEntries   = newGauge("buildkite_stats_local_cache_entries", "Number of intervals in the in-process cache.")
+	reportReloads       = newCounterVec("buildkite_stats_report_reloads_total", "Attempts to reload the reports.", "result")
+	groupErrors         = newCounterVec("buildkite_stats_group_errors_total", "Builds, or jobs, whose group template failed and were put in the "+groupErrorPlaceholder+" group.", "report")
+	scrapeLatency       = newHistogram("buildkite_stats_scrape_duration_seconds", "Time it took to iterate all builds of a report.", []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 120})
+)
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var processMetrics = []metric{cacheRequests, apiRequests, apiRetries, throttledSeconds, rateLimitRemaining, localCacheRequests, localCacheEvictions, localCacheBytes, localCacheEntries, reportReloads, groupErrors, scrapeLatency}
+
+// counterVec is a counter partitioned by a single label.
+type counterVec struct {
+	name  string
+	help  string
+	label string
+
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+func (c *counterVec) Add(labelValue string, v float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[labelValue] += v
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	labelValues := make([]string, 0, len(c.values))
+	for lv := range c.values {
+		labelValues = append(labelValues, lv)
+	}
+	sort.Strings(labelValues)
+	for _, lv := range labelValues {
+		writeSample(w, c.name, labels{{c.label, lv}}, c.values[lv])
+	}
+}
+
+type gauge struct {
+	name string
+	help string
+
+	mutex sync.Mutex
+	value float64
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) Set(v float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.value = v
+}
+
+func (g *gauge) writeTo(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	writeSample(w, g.name, nil, g.value)
+}
+
+// gaugeVec is a gauge partitioned by a single label.
+type gaugeVec struct {
+	name  string
+	help  string
+	label string
+
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func newGaugeVec(name, help, label string) *gaugeVec {
+	return &gaugeVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (g *gaugeVec) Set(labelValue string, v float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[labelValue] = v
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	labelValues := make([]string, 0, len(g.values))
+	for lv := range g.values {
+		labelValues = append(labelValues, lv)
+	}
+	sort.Strings(labelValues)
+	for _, lv := range labelValues {
+		writeSample(w, g.name, labels{{g.label, lv}}, g.values[lv])
+	}
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mutex  sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, upper := range h.buckets {
+		writeSample(w, h.name+"_bucket", labels{{"le", formatFloat(upper)}}, float64(h.counts[i]))
+	}
+	writeSample(w, h.name+"_bucket", labels{{"le", "+Inf"}}, float64(h.count))
+	writeSample(w, h.name+"_sum", nil, h.sum)
+	writeSample(w, h.name+"_count", nil, float64(h.count))
+}
+
+type labels [][2]string
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w io.Writer, name string, ls labels, v float64) {
+	fmt.Fprint(w, name)
+	if len(ls) > 0 {
+		fmt.Fprint(w, "{")
+		for i, l := range ls {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, l[0], labelValueEscaper.Replace(l[1]))
+		}
+		fmt.Fprint(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", formatFloat(v))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// formatWindow formats a rolling window for use as a label value, for example
+// "24h" instead of "24h0m0s".
+func formatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// reportMetrics writes the build counts, total durations and quantiles of
+// every group of every report over each rolling window.
+func (wr *Routes) reportMetrics(w io.Writer, r *http.Request) error {
+	if len(wr.MetricsWindows) == 0 {
+		return nil
+	}
+
+	longestWindow := wr.MetricsWindows[0]
+	for _, window := range wr.MetricsWindows {
+		if window > longestWindow {
+			longestWindow = window
+		}
+	}
+	now := time.Now()
+
+	type key struct {
+		Report string
+		Group  string
+		Window string
+	}
+	queries := wr.Reports.Queries()
+	durations := make(map[key][]time.Duration)
+	missing := make(map[string]int)
+	for _, q := range queries {
+		coverage, err := wr.Buildkite.ForEachBuild(r.Context(), now.Add(-longestWindow), now, q, func(b Build) error {
+			for _, s := range q.Samples(b) {
+				for _, window := range wr.MetricsWindows {
+					if s.When.After(now.Add(-window)) {
+						k := key{q.ID, s.Group, formatWindow(window)}
+						durations[k] = append(durations[k], s.Duration)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		missing[q.ID] = len(coverage.Failed)
+	}
+
+	keys := make([]key, 0, len(durations))
+	for k := range durations {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Report != keys[j].Report {
+			return keys[i].Report < keys[j].Report
+		}
+		if keys[i].Group != keys[j].Group {
+			return keys[i].Group < keys[j].Group
+		}
+		return keys[i].Window < keys[j].Window
+	})
+
+	const (
+		countName    = "buildkite_stats_report_builds"
+		totalName    = "buildkite_stats_report_total_duration_seconds"
+		quantileName = "buildkite_stats_report_duration_seconds"
+		missingName  = "buildkite_stats_report_missing_intervals"
+	)
+	writeHeader(w, missingName, "Number of hourly intervals whose builds could not be fetched and are missing from the report metrics.", "gauge")
+	for _, q := range queries {
+		writeSample(w, missingName, labels{{"report", q.ID}}, float64(missing[q.ID]))
+	}
+	writeHeader(w, countName, "Number of builds (or jobs, for job level reports) per report group within a rolling window.", "gauge")
+	for _, k := range keys {
+		writeSample(w, countName, labels{{"report", k.Report}, {"group", k.Group}, {"window", k.Window}}, float64(len(durations[k])))
+	}
+	writeHeader(w, totalName, "Total duration per report group within a rolling window.", "gauge")
+	for _, k := range keys {
+		var total time.Duration
+		for _, d := range durations[k] {
+			total += d
+		}
+		writeSample(w, totalName, labels{{"report", k.Report}, {"group", k.Group}, {"window", k.Window}}, total.Seconds())
+	}
+	writeHeader(w, quantileName, "Duration quantiles per report group within a rolling window.", "gauge")
+	for _, k := range keys {
+		sort.Sort(durationSlice(durations[k]))
+		for _, quantile := range wr.MetricsQuantiles {
+			writeSample(w, quantileName, labels{{"report", k.Report}, {"group", k.Group}, {"window", k.Window}, {"quantile", formatFloat(quantile)}}, durationPercentile(durations[k], quantile).Seconds())
+		}
+	}
+	return nil
+}
+
+func (wr *Routes) metrics(w http.ResponseWriter, r *http.Request) {
+	// Buffering to be able to return an error status if the reports fail.
+	var buf strings.Builder
+	if err := wr.reportMetrics(&buf, r); err != nil {
+		http.Error(w, fmt.Sprintf("unable to fetch builds: %s", err), 500)
+		return
+	}
+	for _, m := range processMetrics {
+		m.writeTo(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, buf.String())
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportPeriod is the period of time a page or API response covers, chosen
+// using the from and to query parameters.
+type reportPeriod struct {
+	timePeriod
+
+	// Description is a human readable description of the period, like "past
+	// 7 days".
+	Description string
+
+	// params are the from and to query parameters given, to carry the
+	// period over to links. Empty for the default period.
+	params url.Values
+
+	// name prefixes the query parameters of any other period than the main
+	// one, like the baseline of a comparison.
+	name string
+
+	// now is when the period was requested, to resolve related periods
+	// relative to the same time.
+	now time.Time
+}
+
+// period returns the period requested by the from and to query parameters.
+// Each is either a date like 2006-01-02, a RFC 3339 timestamp or relative to
+// now, like 7d. from defaults to ScrapeHistory ago and to defaults to now.
+// Periods starting more than MaxHistory ago are rejected since their builds
+// would have to be fetched from Buildkite.
+func (wr *Routes) period(r *http.Request) (reportPeriod, error) {
+	now := time.Now()
+	return parsePeriod(r.URL.Query(), "", timePeriod{now.Add(-wr.ScrapeHistory), now}, now, now.Add(-wr.MaxHistory))
+}
+
+// baselinePeriod returns the period to compare current to, requested by the
+// baseline_from and baseline_to query parameters. Defaults to the period of the
+// same length right before current.
+func (wr *Routes) baselinePeriod(r *http.Request, current reportPeriod) (reportPeriod, error) {
+	def := timePeriod{current.From.Add(-current.Duration()), current.From}
+	return parsePeriod(r.URL.Query(), "baseline", def, current.now, current.now.Add(-wr.MaxHistory))
+}
+
+// parsePeriod parses the period given by the query parameters of name, which
+// must not start before oldest.
+func parsePeriod(values url.Values, name string, def timePeriod, now, oldest time.Time) (reportPeriod, error) {
+	res := reportPeriod{
+		timePeriod: def,
+		params:     make(url.Values),
+		name:       name,
+		now:        now,
+	}
+
+	if s := values.Get(res.key("from")); s != "" {
+		from, err := parsePeriodTime(s, now, false)
+		if err != nil {
+			return res, fmt.Errorf("%s: %s", res.key("from"), err)
+		}
+		res.From = from
+		res.params.Set(res.key("from"), s)
+	}
+	if s := values.Get(res.key("to")); s != "" {
+		to, err := parsePeriodTime(s, now, true)
+		if err != nil {
+			return res, fmt.Errorf("%s: %s", res.key("to"), err)
+		}
+		res.To = to
+		res.params.Set(res.key("to"), s)
+	}
+	// Builds from the future are yet to be fetched.
+	if res.To.After(now) {
+		res.To = now
+	}
+	if res.From.Before(oldest) {
+		return res, fmt.Errorf("%s (%s) is more than %s ago, see --max-history", res.key("from"), res.From.Format(time.RFC3339), describeDuration(now.Sub(oldest)))
+	}
+	if !res.From.Before(res.To) {
+		return res, fmt.Errorf("%s (%s) must be before %s (%s)", res.key("from"), res.From.Format(time.RFC3339), res.key("to"), res.To.Format(time.RFC3339))
+	}
+
+	switch {
+	case res.To.Equal(now) && !isAbsolutePeriodTime(values.Get(res.key("from"))):
+		res.Description = "past " + describeDuration(now.Sub(res.From))
+	case res.To.Equal(now):
+		res.Description = "since " + res.From.Format(periodTimeFormat(res.From))
+	default:
+		res.Description = fmt.Sprintf("%s to %s", res.From.Format(periodTimeFormat(res.From)), res.To.Format(periodTimeFormat(res.To)))
+	}
+	return res, nil
+}
+
+// key returns the name of the query parameter for the from or to field.
+func (p reportPeriod) key(field string) string {
+	if p.name == "" {
+		return field
+	}
+	return p.name + "_" + field
+}
+
+var relativeTimePattern = regexp.MustCompile(`^(\d+)([mhdw])$`)
+
+var relativeTimeUnits = map[string]time.Duration{
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// isAbsolutePeriodTime returns whether a from or to query parameter is a date
+// or timestamp, as opposed to relative to now.
+func isAbsolutePeriodTime(s string) bool {
+	return s != "" && s != "now" && !relativeTimePattern.MatchString(s)
+}
+
+// parsePeriodTime parses a from or to query parameter. A date given as to
+// includes the whole day.
+func parsePeriodTime(s string, now time.Time, to bool) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if m := relativeTimePattern.FindStringSubmatch(s); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(-time.Duration(n) * relativeTimeUnits[m[2]]), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if to {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a date like 2006-01-02, a RFC 3339 timestamp nor relative like 7d", s)
+}
+
+// describeDuration describes a duration in whole weeks, days, hours or
+// minutes, rounded to the largest unit that matters.
+func describeDuration(d time.Duration) string {
+	const day = 24 * time.Hour
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case d >= 2*day:
+		d = d.Round(day)
+	case d >= 2*time.Hour:
+		d = d.Round(time.Hour)
+	default:
+		d = d.Round(time.Minute)
+	}
+	switch {
+	case d >= 7*day && d%(7*day) == 0:
+		return plural(int64(d/(7*day)), "week")
+	case d >= day && d%day == 0:
+		return plural(int64(d/day), "day")
+	case d >= time.Hour && d%time.Hour == 0:
+		return plural(int64(d/time.Hour), "hour")
+	default:
+		return plural(int64(d/time.Minute), "minute")
+	}
+}
+
+func periodTimeFormat(t time.Time) string {
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+		return "2006-01-02"
+	}
+	return "2006-01-02 15:04"
+}
+
+// LinkQuery returns the query string to append to links to keep the period,
+// and any others given, escaped to be used in HTML.
+func (p reportPeriod) LinkQuery(others ...reportPeriod) string {
+	params := make(url.Values)
+	for _, p := range append([]reportPeriod{p}, others...) {
+		for k, v := range p.params {
+			params[k] = v
+		}
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return html.EscapeString("?" + params.Encode())
+}
+
+// printPeriodPicker prints a form to choose the periods of the current page.
+func printPeriodPicker(w io.Writer, periods ...reportPeriod) {
+	fmt.Fprintf(w, `<form class="form-inline" method="get" style="margin-bottom: 1em">`)
+	for _, p := range periods {
+		label := "From"
+		if p.name != "" {
+			label = strings.Title(p.name) + " from"
+		}
+		fmt.Fprintf(w, `<div class="form-group"><label for="%s">%s</label> <input class="form-control input-sm" type="text" id="%s" name="%s" placeholder="28d or 2006-01-02" value="%s"></div> `, p.key("from"), label, p.key("from"), p.key("from"), html.EscapeString(p.params.Get(p.key("from"))))
+		fmt.Fprintf(w, `<div class="form-group"><label for="%s">to</label> <input class="form-control input-sm" type="text" id="%s" name="%s" placeholder="now" value="%s"></div> `, p.key("to"), p.key("to"), p.key("to"), html.EscapeString(p.params.Get(p.key("to"))))
+	}
+	fmt.Fprintf(w, `<button type="submit" class="btn btn-default btn-sm">Show</button> `)
+	// The presets replace the main period and keep the others, like the
+	// baseline of a comparison.
+	var others []reportPeriod
+	for _, p := range periods {
+		if p.name != "" {
+			others = append(others, p)
+		}
+	}
+	for _, preset := range []string{"1d", "7d", "14d", "28d"} {
+		p := reportPeriod{params: url.Values{"from": {preset}}}
+		fmt.Fprintf(w, `<a href="%s">%s</a> `, p.LinkQuery(others...), preset)
+	}
+	fmt.Fprintf(w, `</form>`)
+}
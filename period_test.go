@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePeriodTime(t *testing.T) {
+	now := time.Date(2024, 3, 15, 13, 30, 0, 0, time.Local)
+	for _, test := range []struct {
+		s       string
+		to      bool
+		want    time.Time
+		wantErr bool
+	}{
+		{s: "now", want: now},
+		{s: "now", to: true, want: now},
+		{s: "30m", want: now.Add(-30 * time.Minute)},
+		{s: "12h", want: now.Add(-12 * time.Hour)},
+		{s: "7d", want: now.Add(-7 * 24 * time.Hour)},
+		{s: "2w", want: now.Add(-14 * 24 * time.Hour)},
+		{s: "2024-03-01", want: time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)},
+		// A date given as to covers the whole day.
+		{s: "2024-03-01", to: true, want: time.Date(2024, 3, 2, 0, 0, 0, 0, time.Local)},
+		{s: "2024-02-29", to: true, want: time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)},
+		{s: "2024-12-31", to: true, want: time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)},
+		{s: "2024-03-01T10:00:00Z", want: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)},
+		// Timestamps are exact, also as to.
+		{s: "2024-03-01T10:00:00+02:00", to: true, want: time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)},
+		{s: "yesterday", wantErr: true},
+		{s: "7", wantErr: true},
+		{s: "7y", wantErr: true},
+		{s: "-7d", wantErr: true},
+		{s: "2024-13-01", wantErr: true},
+	} {
+		got, err := parsePeriodTime(test.s, now, test.to)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parsePeriodTime(%q, to=%v) = %s, want an error", test.s, test.to, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePeriodTime(%q, to=%v): %s", test.s, test.to, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("parsePeriodTime(%q, to=%v) = %s, want %s", test.s, test.to, got, test.want)
+		}
+	}
+}
+
+func TestDescribeDuration(t *testing.T) {
+	day := 24 * time.Hour
+	for _, test := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{28 * day, "4 weeks"},
+		{28*day + 13*time.Minute, "4 weeks"},
+		{14*day + 13*time.Hour, "15 days"},
+		{day, "1 day"},
+		{36 * time.Hour, "36 hours"},
+		{time.Hour, "1 hour"},
+		{5*time.Hour + 20*time.Minute, "5 hours"},
+		{time.Minute + 10*time.Second, "1 minute"},
+	} {
+		if got := describeDuration(test.d); got != test.want {
+			t.Errorf("describeDuration(%s) = %q, want %q", test.d, got, test.want)
+		}
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	now := time.Date(2024, 3, 15, 13, 30, 0, 0, time.Local)
+	day := 24 * time.Hour
+	def := timePeriod{now.Add(-28 * day), now}
+	oldest := now.Add(-56 * day)
+	for _, test := range []struct {
+		query           string
+		name            string
+		want            timePeriod
+		wantDescription string
+		wantLinkQuery   string
+		wantErr         bool
+	}{
+		{
+			query:           "",
+			want:            def,
+			wantDescription: "past 4 weeks",
+			wantLinkQuery:   "",
+		},
+		{
+			query:           "from=7d",
+			want:            timePeriod{now.Add(-7 * day), now},
+			wantDescription: "past 1 week",
+			wantLinkQuery:   "?from=7d",
+		},
+		{
+			query:           "from=2024-03-01&to=2024-03-01",
+			want:            timePeriod{time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local), time.Date(2024, 3, 2, 0, 0, 0, 0, time.Local)},
+			wantDescription: "2024-03-01 to 2024-03-02",
+			wantLinkQuery:   "?from=2024-03-01&amp;to=2024-03-01",
+		},
+		{
+			// Builds from the future are yet to be fetched.
+			query:           "from=1d&to=2024-03-15",
+			want:            timePeriod{now.Add(-day), now},
+			wantDescription: "past 1 day",
+			wantLinkQuery:   "?from=1d&amp;to=2024-03-15",
+		},
+		{
+			query:           "baseline_from=2w&baseline_to=1w&from=1d",
+			name:            "baseline",
+			want:            timePeriod{now.Add(-14 * day), now.Add(-7 * day)},
+			wantDescription: "2024-03-01 13:30 to 2024-03-08 13:30",
+			wantLinkQuery:   "?baseline_from=2w&amp;baseline_to=1w",
+		},
+		{
+			query:           "from=2024-03-01",
+			want:            timePeriod{time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local), now},
+			wantDescription: "since 2024-03-01",
+			wantLinkQuery:   "?from=2024-03-01",
+		},
+		{query: "from=90m", want: timePeriod{now.Add(-90 * time.Minute), now}, wantDescription: "past 90 minutes", wantLinkQuery: "?from=90m"},
+		{query: "from=30m", want: timePeriod{now.Add(-30 * time.Minute), now}, wantDescription: "past 30 minutes", wantLinkQuery: "?from=30m"},
+		{query: "from=56d", want: timePeriod{oldest, now}, wantDescription: "past 8 weeks", wantLinkQuery: "?from=56d"},
+		{query: "from=57d", wantErr: true},
+		{query: "from=520w", wantErr: true},
+		{query: "baseline_from=520w", name: "baseline", wantErr: true},
+		{query: "from=1d&to=7d", wantErr: true},
+		{query: "from=now", wantErr: true},
+		{query: "from=bogus", wantErr: true},
+		{query: "to=bogus", wantErr: true},
+	} {
+		values, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parsePeriod(values, test.name, def, now, oldest)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parsePeriod(%q) = %v, want an error", test.query, got.timePeriod)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePeriod(%q): %s", test.query, err)
+			continue
+		}
+		if !got.From.Equal(test.want.From) || !got.To.Equal(test.want.To) {
+			t.Errorf("parsePeriod(%q) = %s - %s, want %s - %s", test.query, got.From, got.To, test.want.From, test.want.To)
+		}
+		if got.Description != test.wantDescription {
+			t.Errorf("parsePeriod(%q).Description = %q, want %q", test.query, got.Description, test.wantDescription)
+		}
+		if got.LinkQuery() != test.wantLinkQuery {
+			t.Errorf("parsePeriod(%q).LinkQuery() = %q, want %q", test.query, got.LinkQuery(), test.wantLinkQuery)
+		}
+	}
+}
+
+func TestPrintPeriodPickerPresetsKeepOtherPeriods(t *testing.T) {
+	now := time.Date(2024, 3, 15, 13, 30, 0, 0, time.Local)
+	def := timePeriod{now.Add(-28 * 24 * time.Hour), now}
+	parse := func(query, name string) reportPeriod {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := parsePeriod(values, name, def, now, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	for _, test := range []struct {
+		name     string
+		periods  []reportPeriod
+		wantLink string
+	}{
+		{
+			name:     "single period",
+			periods:  []reportPeriod{parse("from=7d&to=1d", "")},
+			wantLink: `<a href="?from=28d">28d</a>`,
+		},
+		{
+			name:     "with baseline",
+			periods:  []reportPeriod{parse("from=7d&baseline_from=2w&baseline_to=1w", ""), parse("from=7d&baseline_from=2w&baseline_to=1w", "baseline")},
+			wantLink: `<a href="?baseline_from=2w&amp;baseline_to=1w&amp;from=28d">28d</a>`,
+		},
+		{
+			name:     "default baseline",
+			periods:  []reportPeriod{parse("from=7d", ""), parse("from=7d", "baseline")},
+			wantLink: `<a href="?from=28d">28d</a>`,
+		},
+	} {
+		var buf bytes.Buffer
+		printPeriodPicker(&buf, test.periods...)
+		if !strings.Contains(buf.String(), test.wantLink) {
+			t.Errorf("%s: printPeriodPicker() = %s, want a link %s", test.name, buf.String(), test.wantLink)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of requests to keep in reserve of Buildkite's rate limit. We
+	// can have this many requests in flight once we learn that we are
+	// close to the limit.
+	rateLimitReserve = fetchConcurrency
+
+	maxRetries = 8
+)
+
+// Variables for tests to retry without waiting for seconds.
+var (
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 1 * time.Minute
+)
+
+// RateLimitedTransport is an http.RoundTripper that keeps all requests within
+// Buildkite's rate limit, as advertised in the RateLimit-Remaining and
+// RateLimit-Reset response headers, and retries rate limited and failed
+// requests with jittered exponential backoff.
+type RateLimitedTransport struct {
+	Transport http.RoundTripper
+
+	// Org is the organization whose rate limit the requests count against,
+	// to tell the metrics of the transports of several apart.
+	Org string
+
+	mutex       sync.Mutex
+	pausedUntil time.Time
+}
+
+func (t *RateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only requests without a body can be safely replayed. We only issue GET
+	// requests anyway. Note that go-buildkite always sets a body, which is
+	// http.NoBody when empty.
+	emptyBody := req.Body == nil || req.Body == http.NoBody
+	retriable := emptyBody && (req.Method == http.MethodGet || req.Method == http.MethodHead)
+
+	for attempt := 0; ; attempt++ {
+		if err := t.wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.Transport.RoundTrip(req)
+		if err != nil {
+			if !retriable || attempt >= maxRetries || req.Context().Err() != nil {
+				return nil, err
+			}
+			log.Printf("Buildkite request failed, retrying (attempt %d/%d): %s", attempt+1, maxRetries, err)
+			apiRetries.Inc("network_error")
+			if err := t.sleep(req.Context(), "backoff", backoffDelay(attempt)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		t.observe(resp)
+
+		reason := retryReason(resp.StatusCode)
+		if reason == "" || !retriable {
+			return resp, nil
+		}
+		if attempt >= maxRetries {
+			if resp.StatusCode != http.StatusTooManyRequests {
+				return resp, nil
+			}
+			// This transport is the only layer retrying rate limited
+			// requests. go-buildkite's Client.Do retries 429 responses to
+			// GET requests as well, for up to 15 minutes and without closing
+			// their bodies, which would multiply our retries and leak a
+			// connection per attempt. Returning an error instead makes it
+			// give up right away.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			return nil, fmt.Errorf("Buildkite rate limit still exceeded after %d retries", maxRetries)
+		}
+
+		delay := backoffDelay(attempt)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			// We are already over the limit. Make sure every other request
+			// waits as well.
+			if reset, ok := rateLimitReset(resp); ok && reset > delay {
+				delay = reset
+			}
+			t.pause(delay)
+		}
+		log.Printf("Buildkite responded %s, retrying in %s (attempt %d/%d).", resp.Status, delay.Round(time.Millisecond), attempt+1, maxRetries)
+		apiRetries.Inc(reason)
+
+		// Allow the connection to be reused.
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if err := t.sleep(req.Context(), "backoff", delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// observe pauses all requests until the rate limit resets if we are about to
+// run out of requests.
+func (t *RateLimitedTransport) observe(resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	rateLimitRemaining.Set(t.Org, float64(remaining))
+
+	if remaining > rateLimitReserve {
+		return
+	}
+	if reset, ok := rateLimitReset(resp); ok && t.pause(reset) {
+		log.Printf("Buildkite rate limit almost exhausted (%d requests remaining), pausing requests for %s.", remaining, reset)
+	}
+}
+
+// pause makes all requests wait for d. Returns false if requests already were
+// paused for longer than that.
+func (t *RateLimitedTransport) pause(d time.Duration) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	until := time.Now().Add(d)
+	if !until.After(t.pausedUntil) {
+		return false
+	}
+	t.pausedUntil = until
+	return true
+}
+
+func (t *RateLimitedTransport) wait(ctx context.Context) error {
+	t.mutex.Lock()
+	d := time.Until(t.pausedUntil)
+	t.mutex.Unlock()
+
+	if d <= 0 {
+		return nil
+	}
+	return t.sleep(ctx, "rate_limit", d)
+}
+
+func (t *RateLimitedTransport) sleep(ctx context.Context, reason string, d time.Duration) error {
+	start := time.Now()
+	// Counting the time actually waited, which is shorter than d if ctx is
+	// canceled.
+	defer func() {
+		throttledSeconds.Add(reason, time.Since(start).Seconds())
+	}()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func retryReason(statusCode int) string {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return "rate_limited"
+	case statusCode >= 500:
+		return "server_error"
+	default:
+		return ""
+	}
+}
+
+// rateLimitReset returns the time until Buildkite's rate limit resets.
+func rateLimitReset(resp *http.Response) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(resp.Header.Get("RateLimit-Reset"))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// backoffDelay returns an exponential backoff delay with full jitter to not
+// have all concurrent fetchers retry in lockstep.
+func backoffDelay(attempt int) time.Duration {
+	ceiling := retryMaxDelay
+	if attempt < 16 && retryBaseDelay<<uint(attempt) < ceiling {
+		ceiling = retryBaseDelay << uint(attempt)
+	}
+	return retryBaseDelay/2 + time.Duration(rand.Int63n(int64(ceiling)))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withShortRetryDelays makes retries wait milliseconds instead of seconds
+// until the returned function is called.
+func withShortRetryDelays() func() {
+	base, max := retryBaseDelay, retryMaxDelay
+	retryBaseDelay, retryMaxDelay = time.Millisecond, 10*time.Millisecond
+	return func() {
+		retryBaseDelay, retryMaxDelay = base, max
+	}
+}
+
+func TestRateLimitedTransportRetries(t *testing.T) {
+	defer withShortRetryDelays()()
+
+	for _, test := range []struct {
+		name   string
+		method string
+		body   string
+		// statuses are responded in turn, repeating the last one.
+		statuses     []int
+		wantRequests int32
+		wantStatus   int
+		// wantErr is the beginning of the expected error, if any.
+		wantErr string
+	}{
+		{
+			name:         "success",
+			statuses:     []int{http.StatusOK},
+			wantRequests: 1,
+			wantStatus:   http.StatusOK,
+		},
+		{
+			name:         "rate limited then success",
+			statuses:     []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusOK},
+			wantRequests: 3,
+			wantStatus:   http.StatusOK,
+		},
+		{
+			name:         "rate limited until giving up",
+			statuses:     []int{http.StatusTooManyRequests},
+			wantRequests: maxRetries + 1,
+			wantErr:      "Buildkite rate limit still exceeded after 8 retries",
+		},
+		{
+			name:         "server error until giving up",
+			statuses:     []int{http.StatusBadGateway},
+			wantRequests: maxRetries + 1,
+			wantStatus:   http.StatusBadGateway,
+		},
+		{
+			name:         "client error",
+			statuses:     []int{http.StatusNotFound},
+			wantRequests: 1,
+			wantStatus:   http.StatusNotFound,
+		},
+		{
+			name:         "request with a body",
+			method:       http.MethodPost,
+			body:         "{}",
+			statuses:     []int{http.StatusTooManyRequests},
+			wantRequests: 1,
+			wantStatus:   http.StatusTooManyRequests,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&requests, 1))
+				if n > len(test.statuses) {
+					n = len(test.statuses)
+				}
+				status := test.statuses[n-1]
+				if status == http.StatusTooManyRequests {
+					w.Header().Set("RateLimit-Remaining", "0")
+					w.Header().Set("RateLimit-Reset", "0")
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, err := http.NewRequest(method, server.URL, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.body == "" {
+				req.Body = http.NoBody
+			}
+
+			resp, err := (&RateLimitedTransport{Transport: http.DefaultTransport}).RoundTrip(req)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if got := atomic.LoadInt32(&requests); got != test.wantRequests {
+				t.Errorf("sent %d requests, want %d", got, test.wantRequests)
+			}
+			switch {
+			case test.wantErr != "":
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Errorf("RoundTrip() error = %v, want %q", err, test.wantErr)
+				}
+				if resp != nil {
+					t.Errorf("RoundTrip() returned a response along with an error")
+				}
+			case err != nil:
+				t.Errorf("RoundTrip(): %s", err)
+			case resp.StatusCode != test.wantStatus:
+				t.Errorf("RoundTrip() status = %d, want %d", resp.StatusCode, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRateLimitedTransportCanceledWhileRateLimited(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("RateLimit-Remaining", "0")
+		w.Header().Set("RateLimit-Reset", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	throttled := counterValue(throttledSeconds, "backoff")
+	start := time.Now()
+	_, err = (&RateLimitedTransport{Transport: http.DefaultTransport}).RoundTrip(req.WithContext(ctx))
+	if err != context.DeadlineExceeded {
+		t.Errorf("RoundTrip() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RoundTrip() returned after %s, want right after the context was canceled", elapsed)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("sent %d requests, want 1", got)
+	}
+	// Only the time actually waited is counted, not the minute until the
+	// rate limit resets.
+	if got := counterValue(throttledSeconds, "backoff") - throttled; got <= 0 || got > 5 {
+		t.Errorf("counted %.3fs throttled, want the time until the context was canceled", got)
+	}
+}
+
+func TestRateLimitedTransportRemainingPerOrg(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Remaining", r.URL.Query().Get("remaining"))
+		w.Header().Set("RateLimit-Reset", "60")
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		org       string
+		remaining string
+	}{
+		{"first", "100"},
+		{"second", "200"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"?remaining="+test.remaining, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&RateLimitedTransport{Transport: http.DefaultTransport, Org: test.org}).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	var buf bytes.Buffer
+	rateLimitRemaining.writeTo(&buf)
+	for _, want := range []string{
+		`buildkite_stats_buildkite_rate_limit_remaining{org="first"} 100`,
+		`buildkite_stats_buildkite_rate_limit_remaining{org="second"} 200`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics = %s, want %s", buf.String(), want)
+		}
+	}
+}
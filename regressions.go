@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// changePointWindow is the number of samples compared on each side of a
+// candidate change point. Groups with fewer than twice as many samples are
+// not analyzed.
+const changePointWindow = 20
+
+// changePointMinZ is the minimum z-score of the Mann-Whitney U test comparing
+// the samples before and after a change point. 3.29 corresponds to a two-sided
+// p-value of 0.001, which is needed since many points are tested.
+const changePointMinZ = 3.29
+
+// changePointContext is the number of builds listed on each side of a change
+// point.
+const changePointContext = 3
+
+// changePoint is a step change in the durations of a timeline.
+type changePoint struct {
+	// At is when the first sample after the change was taken.
+	At time.Time
+
+	// Before and After are the medians of the changePointWindow samples
+	// before and after the change.
+	Before time.Duration
+	After  time.Duration
+
+	Z float64
+
+	// Samples are the samples around the change, where the change happened
+	// between Samples[Split-1] and Samples[Split].
+	Samples []timelineDuration
+	Split   int
+
+	// index is the index of the first sample after the change in the
+	// analyzed timeline.
+	index int
+}
+
+// Slower returns whether durations increased.
+func (c changePoint) Slower() bool {
+	return c.After > c.Before
+}
+
+// detectChangePoints returns the step changes in the durations of items,
+// ordered by time. A change has to be both statistically significant and
+// larger than regressionThreshold.
+//
+// Every point is tested by comparing the changePointWindow samples before it
+// to the ones after it. The most significant point is picked first, and
+// points within a window of an already picked one are ignored.
+func detectChangePoints(items timelineSlice) []changePoint {
+	if len(items) < 2*changePointWindow {
+		return nil
+	}
+
+	var candidates []changePoint
+	for i := changePointWindow; i <= len(items)-changePointWindow; i++ {
+		before := timelineDurations(items[i-changePointWindow : i])
+		after := timelineDurations(items[i : i+changePointWindow])
+
+		z := mannWhitneyZ(after, before)
+		if math.Abs(z) < changePointMinZ {
+			continue
+		}
+		c := changePoint{
+			At:     items[i].When,
+			Before: durationPercentile(before, 0.5),
+			After:  durationPercentile(after, 0.5),
+			Z:      z,
+			index:  i,
+		}
+		if !worsened(c.Before, c.After) && !improved(c.Before, c.After) {
+			continue
+		}
+
+		from, to := i-changePointContext, i+changePointContext
+		if from < 0 {
+			from = 0
+		}
+		if to > len(items) {
+			to = len(items)
+		}
+		c.Samples = items[from:to]
+		c.Split = i - from
+		candidates = append(candidates, c)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return math.Abs(candidates[i].Z) > math.Abs(candidates[j].Z) })
+	var res []changePoint
+	for _, c := range candidates {
+		overlaps := false
+		for _, picked := range res {
+			if c.index > picked.index-changePointWindow && c.index < picked.index+changePointWindow {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].At.Before(res[j].At) })
+	return res
+}
+
+func timelineDurations(items timelineSlice) []time.Duration {
+	res := make([]time.Duration, len(items))
+	for i, item := range items {
+		res[i] = item.Duration
+	}
+	return res
+}
+
+// mannWhitneyZ returns the z-score of the Mann-Whitney U test, using the
+// normal approximation with tie correction. It is positive if values in a
+// tend to be larger than in b.
+func mannWhitneyZ(a, b []time.Duration) float64 {
+	type value struct {
+		d     time.Duration
+		fromA bool
+	}
+	values := make([]value, 0, len(a)+len(b))
+	for _, d := range a {
+		values = append(values, value{d, true})
+	}
+	for _, d := range b {
+		values = append(values, value{d, false})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].d < values[j].d })
+
+	var rankSumA, ties float64
+	for i := 0; i < len(values); {
+		j := i
+		for j < len(values) && values[j].d == values[i].d {
+			j++
+		}
+		// Tied values share the average of their ranks, which are 1-based.
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if values[k].fromA {
+				rankSumA += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	n1, n2 := float64(len(a)), float64(len(b))
+	n := n1 + n2
+	u := rankSumA - n1*(n1+1)/2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 {
+		return 0
+	}
+	return (u - n1*n2/2) / sigma
+}
+
+// stepChange is a change point of a report group.
+type stepChange struct {
+	Report Query
+	Group  string
+	changePoint
+}
+
+// RegressionDetector periodically looks for step changes in the durations of
+// every report group.
+type RegressionDetector struct {
+	Buildkite Buildkite
+	Reports   *Reports
+
+	// History is how far back in time changes are looked for.
+	History time.Duration
+
+	mutex      sync.RWMutex
+	changes    []stepChange
+	coverage   Coverage
+	detectedAt time.Time
+}
+
+// Changes returns the step changes found by the latest detection, most recent
+// first, and when it was run. The time is zero if detection has yet to
+// finish.
+func (d *RegressionDetector) Changes() ([]stepChange, Coverage, time.Time) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.changes, d.coverage, d.detectedAt
+}
+
+// Detect looks for step changes in all groups of all reports.
+func (d *RegressionDetector) Detect(ctx context.Context) error {
+	now := time.Now()
+	period := timePeriod{now.Add(-d.History), now}
+
+	var changes []stepChange
+	var coverage Coverage
+	for _, q := range d.Reports.Queries() {
+		timelines, c, err := groupTimelines(ctx, d.Buildkite, period, q)
+		if err != nil {
+			return fmt.Errorf("report %s: %s", q.ID, err)
+		}
+		coverage = coverage.Merge(c)
+		for group, items := range timelines {
+			for _, cp := range detectChangePoints(items) {
+				changes = append(changes, stepChange{q, group, cp})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].At.After(changes[j].At) })
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.changes = changes
+	d.coverage = coverage
+	d.detectedAt = now
+	return nil
+}
+
+// Run calls Detect right away and then every interval. Never returns.
+func (d *RegressionDetector) Run(interval time.Duration) {
+	for {
+		if err := d.Detect(context.Background()); err != nil {
+			log.Println("unable to detect regressions:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (wr *Routes) regressions(w http.ResponseWriter, r *http.Request) {
+	if wr.Regressions == nil {
+		http.Error(w, "regression detection is disabled, see --regression-interval", http.StatusNotFound)
+		return
+	}
+	changes, coverage, detectedAt := wr.Regressions.Changes()
+
+	setCoverageHeader(w, coverage)
+	wr.printTopHtml(w, r)
+	printCoverageWarning(w, coverage)
+	fmt.Fprintf(w, `<h1>Regressions</h1><p><a href="/">Back to dashboard</a></p>`)
+	if detectedAt.IsZero() {
+		fmt.Fprintf(w, `<p>Builds are still being analyzed. Come back in a while.</p>`)
+		wr.printBottomHtml(w, r)
+		return
+	}
+	fmt.Fprintf(w, `<p>Step changes in build times of the past %s, found %s. A change is listed if the median of the %d builds after it differs by more than %.0f%% from the %d builds before it, and the difference is statistically significant. Slowdowns are marked red.</p>`,
+		describeDuration(wr.Regressions.History), detectedAt.Format(time.RFC822), changePointWindow, 100*regressionThreshold, changePointWindow)
+	if len(changes) == 0 {
+		fmt.Fprintf(w, `<p>No step changes found.</p>`)
+		wr.printBottomHtml(w, r)
+		return
+	}
+
+	fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>When</th><th>Report</th><th>Group</th><th>Median before</th><th>Median after</th><th>Change</th><th>Builds around the change</th></tr>`)
+	for _, c := range changes {
+		class := "success"
+		if c.Slower() {
+			class = "danger"
+		}
+		fmt.Fprintf(w, `<tr class="%s"><td>%s</td><td><a href="/%s/">%s</a></td><th>%s</th><td>%s</td><td>%s</td><td>%s</td><td><ul class="list-unstyled">`,
+			class, c.At.Format(time.RFC822), c.Report.ID, c.Report.Name, html.EscapeString(c.Group),
+			c.Before.Truncate(time.Second), c.After.Truncate(time.Second), formatDelta(float64(c.Before), float64(c.After), (c.After-c.Before).Truncate(time.Second).String()))
+		for i, s := range c.Samples {
+			item := fmt.Sprintf(`%s: %s %s`, s.When.Format(time.RFC822), s.Duration.Truncate(time.Second), buildLink(s.Build))
+			if i == c.Split {
+				item = "<strong>" + item + "</strong>"
+			}
+			fmt.Fprintf(w, `<li>%s</li>`, item)
+		}
+		fmt.Fprintf(w, `</ul></td></tr>`)
+	}
+	fmt.Fprintf(w, `</table>`)
+	wr.printBottomHtml(w, r)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// syntheticTimeline returns hourly samples around the given medians, one per
+// element, with up to jitter of noise.
+func syntheticTimeline(medians []time.Duration, jitter time.Duration, seed int64) timelineSlice {
+	r := rand.New(rand.NewSource(seed))
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	res := make(timelineSlice, len(medians))
+	for i, m := range medians {
+		noise := time.Duration(0)
+		if jitter > 0 {
+			noise = time.Duration(r.Int63n(int64(2*jitter))) - jitter
+		}
+		res[i] = timelineDuration{When: start.Add(time.Duration(i) * time.Hour), Duration: m + noise}
+	}
+	return res
+}
+
+// steps returns n samples of each duration, in order.
+func steps(n int, durations ...time.Duration) []time.Duration {
+	var res []time.Duration
+	for _, d := range durations {
+		for i := 0; i < n; i++ {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+func TestDetectChangePoints(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		items  timelineSlice
+		want   []int
+		slower []bool
+	}{
+		{
+			name:   "step up",
+			items:  syntheticTimeline(steps(100, 10*time.Minute, 13*time.Minute), time.Minute, 1),
+			want:   []int{100},
+			slower: []bool{true},
+		},
+		{
+			name:   "step down",
+			items:  syntheticTimeline(steps(100, 10*time.Minute, 7*time.Minute), time.Minute, 2),
+			want:   []int{100},
+			slower: []bool{false},
+		},
+		{
+			name:   "up and back down",
+			items:  syntheticTimeline(steps(60, 10*time.Minute, 15*time.Minute, 10*time.Minute), time.Minute, 3),
+			want:   []int{60, 120},
+			slower: []bool{true, false},
+		},
+		{
+			name:  "flat",
+			items: syntheticTimeline(steps(200, 10*time.Minute), 0, 4),
+		},
+		{
+			name:  "noise",
+			items: syntheticTimeline(steps(200, 10*time.Minute), 2*time.Minute, 5),
+		},
+		{
+			// Significant, but smaller than regressionThreshold.
+			name:  "small step",
+			items: syntheticTimeline(steps(100, 10*time.Minute, 10*time.Minute+30*time.Second), 10*time.Second, 6),
+		},
+		{
+			name:  "too few samples",
+			items: syntheticTimeline(steps(changePointWindow-1, 10*time.Minute, 20*time.Minute), 0, 7),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := detectChangePoints(test.items)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d change points, want %d: %+v", len(got), len(test.want), got)
+			}
+			for i, c := range got {
+				// The exact point can be off by a sample or two due to noise.
+				if math.Abs(float64(c.index-test.want[i])) > 2 {
+					t.Errorf("change %d at sample %d, want %d", i, c.index, test.want[i])
+				}
+				if !c.At.Equal(test.items[c.index].When) {
+					t.Errorf("change %d at %s, want the time of sample %d", i, c.At, c.index)
+				}
+				if c.Slower() != test.slower[i] {
+					t.Errorf("change %d Slower() = %v, want %v", i, c.Slower(), test.slower[i])
+				}
+				if !c.Samples[c.Split].When.Equal(c.At) {
+					t.Errorf("change %d splits samples at %s, want %s", i, c.Samples[c.Split].When, c.At)
+				}
+			}
+		})
+	}
+}
+
+func TestMannWhitneyZ(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		a, b    []time.Duration
+		wantMin float64
+		wantMax float64
+	}{
+		{"a larger", steps(20, 2), steps(20, 1), changePointMinZ, math.Inf(1)},
+		{"a smaller", steps(20, 1), steps(20, 2), math.Inf(-1), -changePointMinZ},
+		{"all tied", steps(20, 1), steps(20, 1), 0, 0},
+		{"interleaved", []time.Duration{1, 3, 5, 7}, []time.Duration{2, 4, 6, 8}, -1, 0},
+	} {
+		z := mannWhitneyZ(test.a, test.b)
+		if z < test.wantMin || z > test.wantMax {
+			t.Errorf("%s: z = %f, want within [%f, %f]", test.name, z, test.wantMin, test.wantMax)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reports holds the configured reports, which can be replaced while serving
+// without a restart.
+type Reports struct {
+	mutex   sync.RWMutex
+	queries []Query
+	status  ReloadStatus
+}
+
+// ReloadStatus describes the outcome of the latest reload.
+type ReloadStatus struct {
+	// LoadedAt is when the reports being served were loaded.
+	LoadedAt time.Time
+
+	// LastAttempt is when a reload was last attempted, if ever.
+	LastAttempt time.Time
+
+	// LastError is the reason the last attempted reload failed, or nil if it
+	// succeeded.
+	LastError error
+
+	// Warning points out changes that the last successful reload did not
+	// apply, like organizations and tokens which are only read at start.
+	Warning string
+}
+
+func NewReports(queries []Query) *Reports {
+	return &Reports{
+		queries: queries,
+		status:  ReloadStatus{LoadedAt: time.Now()},
+	}
+}
+
+// Queries returns the current reports. Handlers must only call this once per
+// request to work on a consistent set of reports.
+func (r *Reports) Queries() []Query {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.queries
+}
+
+func (r *Reports) Status() ReloadStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.status
+}
+
+// Reload replaces the reports by the ones returned by load. The current
+// reports are kept if load fails. A warning returned by load is kept in the
+// status.
+func (r *Reports) Reload(load func() ([]Query, string, error)) error {
+	queries, warning, err := load()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.status.LastAttempt = time.Now()
+	r.status.LastError = err
+	if err != nil {
+		reportReloads.Inc("failure")
+		return err
+	}
+	reportReloads.Inc("success")
+	r.queries = queries
+	r.status.LoadedAt = r.status.LastAttempt
+	r.status.Warning = warning
+	return nil
+}
+
+// ReloadOnChange reloads the reports on SIGHUP, and whenever the modification
+// time of path changes if pollInterval is positive. Never returns.
+func (r *Reports) ReloadOnChange(path string, pollInterval time.Duration, load func() ([]Query, string, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var poll <-chan time.Time
+	if path != "" && pollInterval > 0 {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	lastModified := modificationTime(path)
+
+	reload := func(reason string) {
+		if err := r.Reload(load); err != nil {
+			log.Printf("Keeping the current reports. Unable to reload reports on %s: %s", reason, err)
+			return
+		}
+		log.Printf("Reloaded %d reports on %s.", len(r.Queries()), reason)
+		if warning := r.Status().Warning; warning != "" {
+			log.Println(warning)
+		}
+	}
+
+	for {
+		select {
+		case <-hup:
+			lastModified = modificationTime(path)
+			reload("SIGHUP")
+		case <-poll:
+			// Kubernetes replaces mounted config maps by swapping a symlink,
+			// which os.Stat follows.
+			modified := modificationTime(path)
+			if modified.Equal(lastModified) {
+				continue
+			}
+			lastModified = modified
+			reload(fmt.Sprintf("change of %s", path))
+		}
+	}
+}
+
+func modificationTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+func (wr *Routes) status(w http.ResponseWriter, r *http.Request) {
+	status := wr.Reports.Status()
+	queries := wr.Reports.Queries()
+
+	wr.printTopHtml(w, r)
+	fmt.Fprintf(w, `<h1>Status</h1><p><a href="/">Back to dashboard</a></p>`)
+	fmt.Fprintf(w, `<h2>Reports</h2><p>Serving %d reports loaded %s.</p>`, len(queries), status.LoadedAt.Format(time.RFC822))
+	switch {
+	case status.LastAttempt.IsZero():
+		fmt.Fprintf(w, `<p>Reports have not been reloaded since start. Send SIGHUP to reload them.</p>`)
+	case status.LastError != nil:
+		fmt.Fprintf(w, `<div class="alert alert-danger"><strong>Reload failed %s.</strong> Still serving the previous reports. %s</div>`, status.LastAttempt.Format(time.RFC822), html.EscapeString(status.LastError.Error()))
+	default:
+		fmt.Fprintf(w, `<p>Last reload succeeded %s.</p>`, status.LastAttempt.Format(time.RFC822))
+	}
+	if status.Warning != "" {
+		fmt.Fprintf(w, `<div class="alert alert-warning">%s</div>`, html.EscapeString(status.Warning))
+	}
+	printReportList(w, queries)
+	wr.printBottomHtml(w, r)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"container/ring"
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+// This file contains the aggregations behind the reports. They are kept
+// separate from web.go to be shared by the HTML pages and the JSON API.
+
+type namedDuration struct {
+	Name     string
+	Duration time.Duration
+}
+type namedDurationSlice []namedDuration
+
+func (d namedDurationSlice) Len() int           { return len(d) }
+func (d namedDurationSlice) Less(i, j int) bool { return d[i].Duration < d[j].Duration }
+func (d namedDurationSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// totalsByGroup returns the total duration per group, longest first.
+func totalsByGroup(ctx context.Context, bk Buildkite, p timePeriod, q Query) (namedDurationSlice, Coverage, error) {
+	sums := make(map[string]time.Duration)
+	coverage, err := bk.ForEachBuild(ctx, p.From, p.To, q, func(b Build) error {
+		for _, s := range q.Samples(b) {
+			sums[s.Group] += s.Duration
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, coverage, err
+	}
+
+	sumsList := make(namedDurationSlice, 0, len(sums))
+	for k, v := range sums {
+		sumsList = append(sumsList, namedDuration{k, v})
+	}
+	sort.Sort(sort.Reverse(sumsList))
+	return sumsList, coverage, nil
+}
+
+// percentilesByGroup returns the perc percentile (0-1) per group, longest
+// first.
+func percentilesByGroup(ctx context.Context, bk Buildkite, p timePeriod, q Query, perc float64) (namedDurationSlice, Coverage, error) {
+	durationsByGroup, coverage, err := durationsByGroup(ctx, bk, p, q)
+	if err != nil {
+		return nil, coverage, err
+	}
+
+	percList := make(namedDurationSlice, 0, len(durationsByGroup))
+	for k, v := range durationsByGroup {
+		percList = append(percList, namedDuration{k, durationPercentile(v, perc)})
+	}
+	sort.Sort(sort.Reverse(percList))
+	return percList, coverage, nil
+}
+
+func durationsByGroup(ctx context.Context, bk Buildkite, p timePeriod, q Query) (map[string][]time.Duration, Coverage, error) {
+	res := make(map[string][]time.Duration)
+	coverage, err := bk.ForEachBuild(ctx, p.From, p.To, q, func(b Build) error {
+		for _, s := range q.Samples(b) {
+			res[s.Group] = append(res[s.Group], s.Duration)
+		}
+		return nil
+	})
+	return res, coverage, err
+}
+
+// chartGroups returns the groups worth charting, that is groups with at least
+// two samples, ordered by name.
+func chartGroups(ctx context.Context, bk Buildkite, p timePeriod, q Query) ([]string, Coverage, error) {
+	counts := make(map[string]int)
+	coverage, err := bk.ForEachBuild(ctx, p.From, p.To, q, func(b Build) error {
+		for _, s := range q.Samples(b) {
+			counts[s.Group]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, coverage, err
+	}
+
+	res := make([]string, 0)
+	for k, count := range counts {
+		if count <= 1 {
+			continue
+		}
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res, coverage, nil
+}
+
+type timelineDuration struct {
+	When     time.Time
+	Duration time.Duration
+
+	// Build is the build the sample was taken from. Zero for averages.
+	Build buildRef
+}
+
+// buildRef identifies a build to link to it.
+type buildRef struct {
+	Number int
+	WebURL string
+	Commit string
+}
+
+func newBuildRef(b Build) buildRef {
+	return buildRef{b.Number, b.WebURL, b.Commit}
+}
+
+type timelineSlice []timelineDuration
+
+func (d timelineSlice) Len() int           { return len(d) }
+func (d timelineSlice) Less(i, j int) bool { return d[i].When.Before(d[j].When) }
+func (d timelineSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// groupTimeline returns all samples of a group, ordered by time.
+func groupTimeline(ctx context.Context, bk Buildkite, p timePeriod, q Query, group string) (timelineSlice, Coverage, error) {
+	items := make(timelineSlice, 0)
+	coverage, err := bk.ForEachBuild(ctx, p.From, p.To, q, func(b Build) error {
+		for _, s := range q.Samples(b) {
+			if s.Group == group {
+				items = append(items, timelineDuration{s.When, s.Duration, newBuildRef(b)})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, coverage, err
+	}
+	sort.Sort(items)
+	return items, coverage, nil
+}
+
+// groupTimelines is like groupTimeline, but for all groups at once.
+func groupTimelines(ctx context.Context, bk Buildkite, p timePeriod, q Query) (map[string]timelineSlice, Coverage, error) {
+	res := make(map[string]timelineSlice)
+	coverage, err := bk.ForEachBuild(ctx, p.From, p.To, q, func(b Build) error {
+		for _, s := range q.Samples(b) {
+			res[s.Group] = append(res[s.Group], timelineDuration{s.When, s.Duration, newBuildRef(b)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, coverage, err
+	}
+	for _, items := range res {
+		sort.Sort(items)
+	}
+	return res, coverage, nil
+}
+
+// rollingAverageWindow is the number of samples that are averaged by
+// rollingAverage.
+const rollingAverageWindow = 15
+
+// rollingAverage replaces the duration of each item with the average of it
+// and up to rollingAverageWindow-1 preceding items.
+func rollingAverage(items timelineSlice) timelineSlice {
+	window := ring.New(rollingAverageWindow)
+
+	res := make(timelineSlice, 0, len(items))
+	for _, sample := range items {
+		// Save duration
+		window.Value = sample.Duration
+
+		// Move ring to the next value
+		window = window.Next()
+
+		// Current average
+		var currentRollingSum time.Duration
+		var currentRollingCount int
+
+		window.Do(func(val interface{}) {
+			if val != nil {
+				currentRollingSum += val.(time.Duration)
+				currentRollingCount++
+			}
+		})
+
+		res = append(res, timelineDuration{When: sample.When, Duration: currentRollingSum / time.Duration(currentRollingCount)})
+	}
+	return res
+}
+
+// buildOutcomes counts builds by their final state.
+type buildOutcomes struct {
+	Name     string
+	Builds   int
+	Passed   int
+	Failed   int
+	Canceled int
+
+	// days are the days builds were created on.
+	days map[time.Time]bool
+}
+
+func (o *buildOutcomes) add(b Build) {
+	o.Builds++
+	if o.days == nil {
+		o.days = make(map[time.Time]bool)
+	}
+	o.days[createdDay(b)] = true
+	switch b.State {
+	case "passed":
+		o.Passed++
+	case "failed":
+		o.Failed++
+	case "canceled":
+		o.Canceled++
+	}
+}
+
+// Days returns the number of days builds were created on, which is the number
+// of points of the daily failure rate chart.
+func (o buildOutcomes) Days() int { return len(o.days) }
+
+func (o buildOutcomes) PassRate() float64    { return ratio(o.Passed, o.Builds) }
+func (o buildOutcomes) FailureRate() float64 { return ratio(o.Failed, o.Builds) }
+func (o buildOutcomes) CancelRate() float64  { return ratio(o.Canceled, o.Builds) }
+
+func ratio(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
+
+type buildOutcomesSlice []buildOutcomes
+
+func (d buildOutcomesSlice) Len() int { return len(d) }
+func (d buildOutcomesSlice) Less(i, j int) bool {
+	if d[i].FailureRate() != d[j].FailureRate() {
+		return d[i].FailureRate() < d[j].FailureRate()
+	}
+	return d[i].Name > d[j].Name
+}
+func (d buildOutcomesSlice) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+
+// outcomesByGroup returns the outcomes per group, highest failure rate first.
+// The states of the query are ignored. A failure rate is meaningless if we
+// only look at passed builds.
+func outcomesByGroup(ctx context.Context, bk Buildkite, p timePeriod, q Query) (buildOutcomesSlice, Coverage, error) {
+	outcomes := make(map[string]*buildOutcomes)
+	coverage, err := bk.ForEachBuild(ctx, p.From, p.To, BuildPredicateFunc(q.MatchesIgnoringState), func(b Build) error {
+		name := q.Group(b)
+		o, ok := outcomes[name]
+		if !ok {
+			o = &buildOutcomes{Name: name}
+			outcomes[name] = o
+		}
+		o.add(b)
+		return nil
+	})
+	if err != nil {
+		return nil, coverage, err
+	}
+
+	outcomesList := make(buildOutcomesSlice, 0, len(outcomes))
+	for _, o := range outcomes {
+		outcomesList = append(outcomesList, *o)
+	}
+	sort.Sort(sort.Reverse(outcomesList))
+	return outcomesList, coverage, nil
+}
+
+// datedOutcomes are the outcomes of builds created on a specific day.
+type datedOutcomes struct {
+	Day time.Time
+	buildOutcomes
+}
+
+// createdDay returns the start of the local day a build was created on.
+func createdDay(b Build) time.Time {
+	return time.Date(b.CreatedAt.Year(), b.CreatedAt.Month(), b.CreatedAt.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// dailyOutcomes returns the outcomes per day of a group, ordered by day.
+func dailyOutcomes(ctx context.Context, bk Buildkite, p timePeriod, q Query, group string) ([]datedOutcomes, Coverage, error) {
+	daily := make(map[time.Time]*buildOutcomes)
+	coverage, err := bk.ForEachBuild(ctx, p.From, p.To, BuildPredicateFunc(q.MatchesIgnoringState), func(b Build) error {
+		if q.Group(b) != group {
+			return nil
+		}
+		day := createdDay(b)
+		o, ok := daily[day]
+		if !ok {
+			o = &buildOutcomes{Name: group}
+			daily[day] = o
+		}
+		o.add(b)
+		return nil
+	})
+	if err != nil {
+		return nil, coverage, err
+	}
+
+	res := make([]datedOutcomes, 0, len(daily))
+	for day, o := range daily {
+		res = append(res, datedOutcomes{day, *o})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Day.Before(res[j].Day) })
+	return res, coverage, nil
+}
+
+type durationSlice []time.Duration
+
+func (d durationSlice) Len() int           { return len(d) }
+func (d durationSlice) Less(i, j int) bool { return d[i] < d[j] }
+func (d durationSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func durationPercentile(a []time.Duration, perc float64) time.Duration {
+	sorted := durationSlice(a)
+	if !sort.IsSorted(sorted) {
+		// Copy to avoid side-effects.
+		sorted = durationSlice(append([]time.Duration(nil), a...))
+		sort.Sort(sorted)
+	}
+
+	element := int(math.Round(float64(len(a)-1) * perc))
+	return sorted[element]
+}
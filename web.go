@@ -1,15 +1,16 @@
 package main
 
 import (
-	"container/ring"
 	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log"
-	"math"
 	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "net/http/pprof"
@@ -20,18 +21,44 @@ import (
 
 type Routes struct {
 	Buildkite     Buildkite
-	Queries       []Query
+	Reports       *Reports
 	ScrapeHistory time.Duration
+
+	// MaxHistory is how far back in time periods requested using from and
+	// to can start.
+	MaxHistory time.Duration
+
+	// MetricsWindows and MetricsQuantiles configure the report metrics
+	// exposed on /metrics.
+	MetricsWindows   []time.Duration
+	MetricsQuantiles []float64
+
+	// Regressions is nil if regression detection is disabled.
+	Regressions *RegressionDetector
 }
 
 func (wr *Routes) Routes() chi.Router {
 	r := chi.NewRouter()
 
 	r.Get("/", wr.root)
-	r.Get("/{query}/", wr.report)
-	r.Get("/{query}/rolling-average", wr.report)
-
-	r.Get("/{query}/charts/{pipeline}/{mode}", wr.charts)
+	r.Mount("/api/v1", wr.apiRoutes())
+	r.Get("/agents/", wr.agents)
+	r.Get("/agents/{org}/{queue}/concurrency", wr.concurrencyChart)
+	r.Route("/{query}", func(r chi.Router) {
+		r.Use(wr.redirectIndex)
+		r.Get("/", wr.report)
+		r.Get("/rolling-average", wr.report)
+
+		r.Get("/charts/{pipeline}/{mode}", wr.charts)
+		r.Get("/failure-rate/{pipeline}", wr.failureRateChart)
+		r.Get("/steps/{pipeline}", wr.steps)
+		r.Get("/critical-path", wr.criticalPath)
+		r.Get("/hourly", wr.hourly)
+		r.Get("/compare", wr.compare)
+	})
+	r.Get("/regressions", wr.regressions)
+	r.Get("/metrics", wr.metrics)
+	r.Get("/status", wr.status)
 	r.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("pong"))
 	})
@@ -42,44 +69,125 @@ func (wr *Routes) Routes() chi.Router {
 func (wr *Routes) root(w http.ResponseWriter, r *http.Request) {
 	wr.printTopHtml(w, r)
 	fmt.Fprintf(w, `<h1>Buildkite Dashboard</h1>`)
-	fmt.Fprintf(w, `<ul>`)
-	for i, q := range wr.Queries {
-		fmt.Fprintf(w, `<li><a href="/%d/">%s</a></li>`, i, q.Name)
-	}
-	fmt.Fprintf(w, `</ul>`)
+	printReportList(w, wr.Reports.Queries())
+	fmt.Fprintf(w, `<p><a href="/agents/">Agent utilization</a> | <a href="/regressions">Regressions</a> | <a href="/status">Status</a></p>`)
 	wr.printBottomHtml(w, r)
 }
 
-func (wr *Routes) query(r *http.Request) (int, Query, error) {
-	query := chi.URLParam(r, "query")
-	i, err := strconv.Atoi(query)
-	if err != nil {
-		return i, Query{}, err
+func (wr *Routes) query(r *http.Request) (Query, error) {
+	id := chi.URLParam(r, "query")
+	for _, q := range wr.Reports.Queries() {
+		if q.ID == id {
+			return q, nil
+		}
 	}
-	if i < 0 || i >= len(wr.Queries) {
-		return i, Query{}, errors.New("query missing")
+	return Query{}, errors.New("query missing")
+}
+
+// redirectIndex redirects URLs referring to a report by its index, the only
+// way to refer to reports before they had ids, to its id.
+func (wr *Routes) redirectIndex(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		param := chi.URLParam(r, "query")
+		i, err := strconv.Atoi(param)
+		queries := wr.Reports.Queries()
+		if err != nil || i < 0 || i >= len(queries) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Working on the escaped path to keep escaped slashes in groups.
+		path := r.URL.EscapedPath()
+		segment := "/" + param
+		idx := strings.Index(path+"/", segment+"/")
+		if idx < 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target := path[:idx] + "/" + queries[i].ID + path[idx+len(segment):]
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+}
+
+// reportNotFound responds with a page listing the available reports.
+func (wr *Routes) reportNotFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	wr.printTopHtml(w, r)
+	fmt.Fprintf(w, `<h1>Report not found</h1><p>There is no report with id '%s'. Available reports are:</p>`, html.EscapeString(chi.URLParam(r, "query")))
+	printReportList(w, wr.Reports.Queries())
+	wr.printBottomHtml(w, r)
+}
+
+func printReportList(w io.Writer, queries []Query) {
+	fmt.Fprintf(w, `<ul>`)
+	for _, q := range queries {
+		fmt.Fprintf(w, `<li><a href="/%s/">%s</a></li>`, q.ID, q.Name)
 	}
-	return i, wr.Queries[i], nil
+	fmt.Fprintf(w, `</ul>`)
 }
 
 func (wr *Routes) report(w http.ResponseWriter, r *http.Request) {
-	queryIndex, query, err := wr.query(r)
+	query, err := wr.query(r)
 	if err != nil {
-		http.NotFound(w, r)
+		wr.reportNotFound(w, r)
 		return
 	}
 
 	chartMode := "all"
-	log.Println(chi.RouteContext(r.Context()).RoutePattern())
 	if chi.RouteContext(r.Context()).RoutePattern() == "/{query}/rolling-average" {
 		chartMode = "rolling-average"
 	}
 
-	wr.printTopHtml(w, r)
+	period, err := wr.period(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Everything is computed up front to be able to respond with an error
+	// status if builds could not be fetched.
+	totals, coverage, err := totalsByGroup(r.Context(), wr.Buildkite, period.timePeriod, query)
+	if respondFetchError(w, coverage, err) {
+		return
+	}
+	const perc = 90
+	percentiles, c, err := percentilesByGroup(r.Context(), wr.Buildkite, period.timePeriod, query, float64(perc)/100)
+	if respondFetchError(w, c, err) {
+		return
+	}
+	coverage = coverage.Merge(c)
+	var outcomes buildOutcomesSlice
+	if !query.JobLevel() {
+		// Outcomes are about builds, not jobs.
+		outcomes, c, err = outcomesByGroup(r.Context(), wr.Buildkite, period.timePeriod, query)
+		if respondFetchError(w, c, err) {
+			return
+		}
+		coverage = coverage.Merge(c)
+	}
+	groups, c, err := chartGroups(r.Context(), wr.Buildkite, period.timePeriod, query)
+	if respondFetchError(w, c, err) {
+		return
+	}
+	coverage = coverage.Merge(c)
+
+	wr.printReportTopHtml(w, r, period, coverage)
 	fmt.Fprintf(w, `<h1>%s</h1>`, query.Name)
-	wr.totalTopList(w, r, query)
-	wr.percentileTopList(w, r, 90, query)
-	wr.printCharts(w, r, chartMode, queryIndex, query)
+	if query.JobLevel() {
+		fmt.Fprintf(w, `<p><a href="/%s/hourly%s">Percentiles per hour of day</a> | <a href="/%s/compare%s">Compare to previous period</a></p>`, query.ID, period.LinkQuery(), query.ID, period.LinkQuery())
+	} else {
+		fmt.Fprintf(w, `<p><a href="/%s/critical-path%s">Critical path analysis</a> | <a href="/%s/hourly%s">Percentiles per hour of day</a> | <a href="/%s/compare%s">Compare to previous period</a></p>`, query.ID, period.LinkQuery(), query.ID, period.LinkQuery(), query.ID, period.LinkQuery())
+	}
+	totalTopList(w, query, period, totals)
+	percentileTopList(w, perc, period, percentiles)
+	if !query.JobLevel() {
+		outcomeTopList(w, query, period, outcomes)
+	}
+	printCharts(w, chartMode, query, period, groups)
 	wr.printBottomHtml(w, r)
 }
 
@@ -111,6 +219,27 @@ func (wr *Routes) printTopHtml(w http.ResponseWriter, r *http.Request) {
           <div class="col-md-12">`)
 }
 
+// printReportTopHtml is like printTopHtml, but also prints a period picker
+// and warns about builds missing from the report.
+func (wr *Routes) printReportTopHtml(w http.ResponseWriter, r *http.Request, p reportPeriod, c Coverage) {
+	setCoverageHeader(w, c)
+	wr.printTopHtml(w, r)
+	printPeriodPicker(w, p)
+	printCoverageWarning(w, c)
+}
+
+func printCoverageWarning(w io.Writer, c Coverage) {
+	if c.Complete() {
+		return
+	}
+
+	fmt.Fprintf(w, `<div class="alert alert-warning"><strong>Incomplete data.</strong> Builds created during these hours could not be fetched from Buildkite and are missing:<ul>`)
+	for _, p := range c.Missing() {
+		fmt.Fprintf(w, `<li>%s to %s</li>`, p.From.Format(time.RFC822), p.To.Format(time.RFC822))
+	}
+	fmt.Fprintf(w, `</ul></div>`)
+}
+
 func (wr *Routes) printBottomHtml(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, `
 	      </div>
@@ -122,165 +251,332 @@ func (wr *Routes) printBottomHtml(w http.ResponseWriter, r *http.Request) {
 		`)
 }
 
-type namedDuration struct {
-	Name     string
-	Duration time.Duration
+func totalTopList(w io.Writer, q Query, p reportPeriod, sumsList namedDurationSlice) {
+	fmt.Fprintf(w, `<h2>Total time spent building staging %s</h2>`, p.Description)
+
+	fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>Pipeline</th><th>Total Duration</th></tr>`)
+	for _, pipeline := range sumsList {
+		if q.JobLevel() {
+			fmt.Fprintf(w, `<tr><th>%s</th><td>%s</td></tr>`, html.EscapeString(pipeline.Name), pipeline.Duration)
+		} else {
+			fmt.Fprintf(w, `<tr><th><a href="/%s/steps/%s%s">%s</a></th><td>%s</td></tr>`, q.ID, pathSegment(pipeline.Name), p.LinkQuery(), html.EscapeString(pipeline.Name), pipeline.Duration)
+		}
+	}
+	fmt.Fprintf(w, `</table>`)
+}
+
+func percentileTopList(w io.Writer, perc int, p reportPeriod, percList namedDurationSlice) {
+	fmt.Fprintf(w, `<h2>%dth percentile of time spent building staging %s</h2>`, perc, p.Description)
+
+	fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>Pipeline</th><th>%dth percentile</th></tr>`, perc)
+	for _, pipeline := range percList {
+		fmt.Fprintf(w, `<tr><th>%s</th><td>%s</td></tr>`, html.EscapeString(pipeline.Name), pipeline.Duration.Truncate(time.Second))
+	}
+	fmt.Fprintf(w, `</table>`)
+}
+
+func outcomeTopList(w io.Writer, q Query, p reportPeriod, outcomesList buildOutcomesSlice) {
+	fmt.Fprintf(w, `<h2>Build outcomes %s</h2><p>...for builds in all states.</p>`, p.Description)
+	fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>Pipeline</th><th>Builds</th><th>Pass rate</th><th>Failure rate</th><th>Cancel rate</th></tr>`)
+	for _, o := range outcomesList {
+		fmt.Fprintf(w, `<tr><th>%s</th><td>%d</td><td>%.1f%%</td><td>%.1f%%</td><td>%.1f%%</td></tr>`, html.EscapeString(o.Name), o.Builds, 100*o.PassRate(), 100*o.FailureRate(), 100*o.CancelRate())
+	}
+	fmt.Fprintf(w, `</table>`)
+
+	fmt.Fprintf(w, `<h2>Daily failure rate</h2><p>...for pipelines with at least one failed build and builds on at least two days.</p>`)
+	for _, o := range outcomesList {
+		if o.Failed == 0 || o.Days() < 2 {
+			continue
+		}
+		fmt.Fprintf(w, `<h3>%s</h3><img src="/%s/failure-rate/%s%s" />`, html.EscapeString(o.Name), q.ID, pathSegment(o.Name), p.LinkQuery())
+	}
 }
-type namedDurationSlice []namedDuration
 
-func (d namedDurationSlice) Len() int           { return len(d) }
-func (d namedDurationSlice) Less(i, j int) bool { return d[i].Duration < d[j].Duration }
-func (d namedDurationSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+type stepDurations struct {
+	Name  string
+	Jobs  int
+	Total time.Duration
+	P50   time.Duration
+	P90   time.Duration
+}
 
-func (wr *Routes) totalTopList(w http.ResponseWriter, r *http.Request, q Query) {
-	builds, err := wr.Buildkite.ListBuilds(wr.fromTime(r), q)
+func (wr *Routes) steps(w http.ResponseWriter, r *http.Request) {
+	pipeline := urlParam(r, "pipeline")
+
+	query, err := wr.query(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("unable to fetch builds: %s", err), 500)
+		wr.reportNotFound(w, r)
+		return
+	}
+	if query.JobLevel() {
+		http.NotFound(w, r)
 		return
 	}
 
-	fmt.Fprintf(w, `<h2>Total time spent building staging past 4 weeks</h2>`)
-
-	sums := make(map[string]time.Duration)
-	for _, b := range builds {
-		name := q.Group(b)
-		sums[name] += q.Duration(b)
+	period, err := wr.period(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	sumsList := make(namedDurationSlice, 0, len(sums))
-	for k, v := range sums {
-		sumsList = append(sumsList, namedDuration{k, v})
+	durationsByStep := make(map[string][]time.Duration)
+	coverage, err := wr.Buildkite.ForEachBuild(r.Context(), period.From, period.To, query, func(b Build) error {
+		if query.Group(b) != pipeline {
+			return nil
+		}
+		for _, j := range b.Jobs {
+			if d, ok := j.Duration(); ok {
+				durationsByStep[j.Step()] = append(durationsByStep[j.Step()], d)
+			}
+		}
+		return nil
+	})
+	if respondFetchError(w, coverage, err) {
+		return
 	}
-	sort.Sort(sort.Reverse(sumsList))
 
-	fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>Pipeline</th><th>Total Duration</th></tr>`)
-	for _, pipeline := range sumsList {
-		fmt.Fprintf(w, `<tr><th>%s</th><td>%s</td></tr>`, pipeline.Name, pipeline.Duration)
+	steps := make([]stepDurations, 0, len(durationsByStep))
+	for name, durations := range durationsByStep {
+		var total time.Duration
+		for _, d := range durations {
+			total += d
+		}
+		steps = append(steps, stepDurations{
+			Name:  name,
+			Jobs:  len(durations),
+			Total: total,
+			P50:   durationPercentile(durations, 0.5),
+			P90:   durationPercentile(durations, 0.9),
+		})
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].Total > steps[j].Total })
+
+	wr.printReportTopHtml(w, r, period, coverage)
+	fmt.Fprintf(w, `<h1>%s</h1><p><a href="/%s/%s">Back to %s</a></p>`, html.EscapeString(pipeline), query.ID, period.LinkQuery(), query.Name)
+	fmt.Fprintf(w, `<h2>Time spent per step %s</h2><p>...measured from when a job started until it finished.</p>`, period.Description)
+	fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>Step</th><th>Jobs</th><th>Total Duration</th><th>50th percentile</th><th>90th percentile</th></tr>`)
+	for _, step := range steps {
+		fmt.Fprintf(w, `<tr><th>%s</th><td>%d</td><td>%s</td><td>%s</td><td>%s</td></tr>`, html.EscapeString(step.Name), step.Jobs, step.Total, step.P50.Truncate(time.Second), step.P90.Truncate(time.Second))
 	}
 	fmt.Fprintf(w, `</table>`)
+	wr.printBottomHtml(w, r)
 }
 
-func (wr *Routes) percentileTopList(w http.ResponseWriter, r *http.Request, perc int, q Query) {
-	builds, err := wr.Buildkite.ListBuilds(wr.fromTime(r), q)
+func (wr *Routes) criticalPath(w http.ResponseWriter, r *http.Request) {
+	query, err := wr.query(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("unable to fetch builds: %s", err), 500)
+		wr.reportNotFound(w, r)
+		return
+	}
+	if query.JobLevel() {
+		http.NotFound(w, r)
 		return
 	}
 
-	fmt.Fprintf(w, `<h2>%dth percentile of time spent building staging past 4 weeks</h2>`, perc)
-	fperc := float64(perc) / 100
-
-	durationsByPipeline := make(map[string][]time.Duration)
-	for _, b := range builds {
-		name := q.Group(b)
-		durationsByPipeline[name] = append(durationsByPipeline[name], q.Duration(b))
+	period, err := wr.period(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	sumsList := make(namedDurationSlice, 0, len(durationsByPipeline))
-	for k, v := range durationsByPipeline {
-		sumsList = append(sumsList, namedDuration{k, durationPercentile(v, fperc)})
+	groups := make(map[string]*criticalPathGroup)
+	coverage, err := wr.Buildkite.ForEachBuild(r.Context(), period.From, period.To, query, func(b Build) error {
+		name := query.Group(b)
+		g, ok := groups[name]
+		if !ok {
+			g = newCriticalPathGroup(name)
+			groups[name] = g
+		}
+		g.add(b)
+		return nil
+	})
+	if respondFetchError(w, coverage, err) {
+		return
 	}
-	sort.Sort(sort.Reverse(sumsList))
 
-	fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>Pipeline</th><th>%dth percentile</th></tr>`, perc)
-	for _, pipeline := range sumsList {
-		fmt.Fprintf(w, `<tr><th>%s</th><td>%s</td></tr>`, pipeline.Name, pipeline.Duration.Truncate(time.Second))
+	names := make([]string, 0, len(groups))
+	for name, g := range groups {
+		if g.Builds > 0 {
+			names = append(names, name)
+		}
 	}
-	fmt.Fprintf(w, `</table>`)
+	sort.Strings(names)
+
+	wr.printReportTopHtml(w, r, period, coverage)
+	fmt.Fprintf(w, `<h1>%s</h1><p><a href="/%s/%s">Back to %s</a></p>`, query.Name, query.ID, period.LinkQuery(), query.Name)
+	fmt.Fprintf(w, `<h2>Critical path %s</h2><p>The critical path is the chain of steps that determined how long a build took. Speeding up a step that is not on it will not make builds finish sooner. Steps are ranked by their total time on the critical path.</p>`, period.Description)
+	for _, name := range names {
+		g := groups[name]
+		fmt.Fprintf(w, `<h3>%s</h3><p>%d builds.</p>`, html.EscapeString(name), g.Builds)
+		fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>Step</th><th>On critical path</th><th>Total time on critical path</th><th>Average time on critical path</th></tr>`)
+		for _, step := range g.Steps() {
+			fmt.Fprintf(w, `<tr><th>%s</th><td>%.1f%%</td><td>%s</td><td>%s</td></tr>`, html.EscapeString(step.Name), 100*ratio(step.OnPath, g.Builds), step.Duration, step.Average().Truncate(time.Second))
+		}
+		fmt.Fprintf(w, `</table>`)
+	}
+	wr.printBottomHtml(w, r)
 }
 
-type durationSlice []time.Duration
+func (wr *Routes) hourly(w http.ResponseWriter, r *http.Request) {
+	query, err := wr.query(r)
+	if err != nil {
+		wr.reportNotFound(w, r)
+		return
+	}
 
-func (d durationSlice) Len() int           { return len(d) }
-func (d durationSlice) Less(i, j int) bool { return d[i] < d[j] }
-func (d durationSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+	period, err := wr.period(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-func durationPercentile(a []time.Duration, perc float64) time.Duration {
-	sorted := durationSlice(a)
-	if !sort.IsSorted(sorted) {
-		// Copy to avoid side-effects.
-		sorted = durationSlice(append([]time.Duration(nil), a...))
-		sort.Sort(sorted)
+	// Indexed by group and hour of day.
+	durations := make(map[string]*[24][]time.Duration)
+	coverage, err := wr.Buildkite.ForEachBuild(r.Context(), period.From, period.To, query, func(b Build) error {
+		for _, s := range query.Samples(b) {
+			hours, ok := durations[s.Group]
+			if !ok {
+				hours = new([24][]time.Duration)
+				durations[s.Group] = hours
+			}
+			hour := s.When.Local().Hour()
+			hours[hour] = append(hours[hour], s.Duration)
+		}
+		return nil
+	})
+	if respondFetchError(w, coverage, err) {
+		return
 	}
 
-	element := int(math.Round(float64(len(a)-1) * perc))
-	return sorted[element]
+	names := make([]string, 0, len(durations))
+	for name := range durations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	wr.printReportTopHtml(w, r, period, coverage)
+	fmt.Fprintf(w, `<h1>%s</h1><p><a href="/%s/%s">Back to %s</a></p>`, query.Name, query.ID, period.LinkQuery(), query.Name)
+	fmt.Fprintf(w, `<h2>Percentiles per hour of day %s</h2><p>...by the hour of the '%s' timestamp in the time zone of the server.</p>`, period.Description, query.from)
+	for _, name := range names {
+		fmt.Fprintf(w, `<h3>%s</h3>`, html.EscapeString(name))
+		fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>Hour</th><th>Count</th><th>50th percentile</th><th>90th percentile</th><th>99th percentile</th></tr>`)
+		for hour, hd := range durations[name] {
+			if len(hd) == 0 {
+				fmt.Fprintf(w, `<tr><th>%02d:00</th><td>0</td><td></td><td></td><td></td></tr>`, hour)
+				continue
+			}
+			sort.Sort(durationSlice(hd))
+			fmt.Fprintf(w, `<tr><th>%02d:00</th><td>%d</td><td>%s</td><td>%s</td><td>%s</td></tr>`, hour, len(hd), durationPercentile(hd, 0.5).Truncate(time.Second), durationPercentile(hd, 0.9).Truncate(time.Second), durationPercentile(hd, 0.99).Truncate(time.Second))
+		}
+		fmt.Fprintf(w, `</table>`)
+	}
+	wr.printBottomHtml(w, r)
 }
 
-func (wr *Routes) printCharts(w http.ResponseWriter, r *http.Request, chartMode string, queryIndex int, q Query) {
-	builds, err := wr.Buildkite.ListBuilds(wr.fromTime(r), q)
+func (wr *Routes) compare(w http.ResponseWriter, r *http.Request) {
+	query, err := wr.query(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("unable to fetch builds: %s", err), 500)
+		wr.reportNotFound(w, r)
 		return
 	}
 
-	fmt.Fprintf(w, `<h2>Build times over time</h2><p>...for builds with at least two builds.</p>`)
-
-	if chartMode == "rolling-average" {
-		fmt.Fprintf(w, `<p>Currently displaying the rolling average (15 builds). <a href="/%d/">Display all individual build times</a></p>`, queryIndex)
-	} else {
-		fmt.Fprintf(w, `<p>Currently displaying all builds individually. <a href="/%d/rolling-average">Display rolling average</a></p>`, queryIndex)
+	period, err := wr.period(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	baseline, err := wr.baselinePeriod(r, period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	activePipelines := make(map[string]int)
-	for _, b := range builds {
-		name := q.Group(b)
-		activePipelines[name]++
+	comparisons, coverage, err := compareGroups(r.Context(), wr.Buildkite, baseline.timePeriod, period.timePeriod, query)
+	if respondFetchError(w, coverage, err) {
+		return
 	}
 
-	orderedList := make([]string, 0)
-	for k, count := range activePipelines {
-		if count <= 1 {
-			continue
+	wr.printTopHtml(w, r)
+	printPeriodPicker(w, period, baseline)
+	printCoverageWarning(w, coverage)
+	fmt.Fprintf(w, `<h1>%s</h1><p><a href="/%s/%s">Back to %s</a></p>`, query.Name, query.ID, period.LinkQuery(), query.Name)
+	fmt.Fprintf(w, `<h2>Compared to previous period</h2><p>Current period: %s. Baseline: %s.</p>`, period.Description, baseline.Description)
+	fmt.Fprintf(w, `<p>Groups whose 50th or 90th percentile got more than %.0f%% slower are marked red, and more than %.0f%% faster green.</p>`, 100*regressionThreshold, 100*regressionThreshold)
+	fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>Pipeline</th><th>Count</th><th>Total Duration</th><th>50th percentile</th><th>90th percentile</th></tr>`)
+	for _, c := range comparisons {
+		class := ""
+		switch {
+		case c.Regressed():
+			class = "danger"
+		case c.Improved():
+			class = "success"
+		}
+		fmt.Fprintf(w, `<tr class="%s"><th>%s</th>`, class, html.EscapeString(c.Name))
+		fmt.Fprintf(w, `<td>%d &rarr; %d<br><small>%s</small></td>`, c.Baseline.Count, c.Current.Count, formatDelta(float64(c.Baseline.Count), float64(c.Current.Count), strconv.Itoa(c.Current.Count-c.Baseline.Count)))
+		for _, d := range [][2]time.Duration{
+			{c.Baseline.Total, c.Current.Total},
+			{c.Baseline.P50, c.Current.P50},
+			{c.Baseline.P90, c.Current.P90},
+		} {
+			before, after := d[0].Truncate(time.Second), d[1].Truncate(time.Second)
+			fmt.Fprintf(w, `<td>%s &rarr; %s<br><small>%s</small></td>`, before, after, formatDelta(float64(before), float64(after), (after-before).String()))
 		}
-		orderedList = append(orderedList, k)
+		fmt.Fprintf(w, `</tr>`)
 	}
-	sort.Strings(orderedList)
+	fmt.Fprintf(w, `</table>`)
+	wr.printBottomHtml(w, r)
+}
 
-	for _, pipeline := range orderedList {
-		fmt.Fprintf(w, `<h3>%s</h3><img src="/%d/charts/%s/%s" />`, pipeline, queryIndex, url.PathEscape(pipeline), chartMode)
+// formatDelta formats the absolute delta, given as abs, and the relative delta
+// between before and after.
+func formatDelta(before, after float64, abs string) string {
+	if after >= before {
+		abs = "+" + abs
 	}
+	if delta, ok := relativeDelta(before, after); ok {
+		return fmt.Sprintf("%s (%+.1f%%)", abs, 100*delta)
+	}
+	return abs
 }
 
-type timelineDuration struct {
-	When     time.Time
-	Duration time.Duration
-}
-type timelineSlice []timelineDuration
+func printCharts(w io.Writer, chartMode string, q Query, p reportPeriod, groups []string) {
+	fmt.Fprintf(w, `<h2>Build times over time</h2><p>...for builds with at least two builds.</p>`)
 
-func (d timelineSlice) Len() int           { return len(d) }
-func (d timelineSlice) Less(i, j int) bool { return d[i].When.Before(d[j].When) }
-func (d timelineSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+	if chartMode == "rolling-average" {
+		fmt.Fprintf(w, `<p>Currently displaying the rolling average (15 builds). <a href="/%s/%s">Display all individual build times</a></p>`, q.ID, p.LinkQuery())
+	} else {
+		fmt.Fprintf(w, `<p>Currently displaying all builds individually. <a href="/%s/rolling-average%s">Display rolling average</a></p>`, q.ID, p.LinkQuery())
+	}
+
+	for _, pipeline := range groups {
+		fmt.Fprintf(w, `<h3>%s</h3><img src="/%s/charts/%s/%s%s" />`, html.EscapeString(pipeline), q.ID, pathSegment(pipeline), chartMode, p.LinkQuery())
+	}
+}
 
 func DurationValueFormatter(v interface{}) string {
 	return time.Duration(time.Duration(v.(float64)) * time.Second).Truncate(time.Second).String()
 }
 
 func (wr *Routes) charts(w http.ResponseWriter, r *http.Request) {
-	pipeline := chi.URLParam(r, "pipeline")
+	pipeline := urlParam(r, "pipeline")
 	mode := chi.URLParam(r, "mode")
 
-	_, query, err := wr.query(r)
+	query, err := wr.query(r)
 	if err != nil {
-		http.NotFound(w, r)
+		wr.reportNotFound(w, r)
 		return
 	}
 
-	builds, err := wr.Buildkite.ListBuilds(wr.fromTime(r), query)
+	period, err := wr.period(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("unable to fetch builds: %s", err), 500)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	items := make(timelineSlice, 0)
-	for _, b := range builds {
-		name := query.Group(b)
-		if name != pipeline {
-			continue
-		}
-		items = append(items, timelineDuration{b.StartedAt, query.Duration(b)})
+	items, coverage, err := groupTimeline(r.Context(), wr.Buildkite, period.timePeriod, query, pipeline)
+	if respondFetchError(w, coverage, err) {
+		return
 	}
-	sort.Sort(items)
 
 	var ts chart.TimeSeries
 
@@ -310,6 +606,229 @@ func (wr *Routes) charts(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
+	markIncomplete(&graph, coverage)
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := graph.Render(chart.PNG, w); err != nil {
+		log.Println(err)
+	}
+}
+
+func (wr *Routes) failureRateChart(w http.ResponseWriter, r *http.Request) {
+	pipeline := urlParam(r, "pipeline")
+
+	query, err := wr.query(r)
+	if err != nil {
+		wr.reportNotFound(w, r)
+		return
+	}
+	if query.JobLevel() {
+		http.NotFound(w, r)
+		return
+	}
+
+	period, err := wr.period(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	daily, coverage, err := dailyOutcomes(r.Context(), wr.Buildkite, period.timePeriod, query, pipeline)
+	if respondFetchError(w, coverage, err) {
+		return
+	}
+	if len(daily) < 2 {
+		http.Error(w, "a chart needs builds on at least two days", http.StatusNotFound)
+		return
+	}
+
+	ts := chart.TimeSeries{
+		Style: chart.Style{
+			DotWidth: 3,
+			Show:     true,
+		},
+	}
+	for _, day := range daily {
+		ts.XValues = append(ts.XValues, day.Day)
+		ts.YValues = append(ts.YValues, 100*day.FailureRate())
+	}
+
+	graph := chart.Chart{
+		XAxis: chart.XAxis{
+			Style: chart.StyleShow(),
+		},
+		Series: []chart.Series{ts},
+		Height: 350,
+		Width:  980,
+		YAxis: chart.YAxis{
+			Name:           "Failure rate",
+			NameStyle:      chart.StyleShow(),
+			Style:          chart.StyleShow(),
+			ValueFormatter: PercentValueFormatter,
+			Range: &chart.ContinuousRange{
+				Min: 0,
+				Max: 100,
+			},
+		},
+	}
+
+	markIncomplete(&graph, coverage)
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := graph.Render(chart.PNG, w); err != nil {
+		log.Println(err)
+	}
+}
+
+// markIncomplete titles a chart of incomplete data. Pages print
+// printCoverageWarning instead, but the images they embed fetch builds on
+// their own and can be missing others.
+func markIncomplete(graph *chart.Chart, c Coverage) {
+	if c.Complete() {
+		return
+	}
+	graph.Title = fmt.Sprintf("Incomplete data: builds of %d out of %d hourly intervals are missing", len(c.Failed), c.Intervals)
+	graph.TitleStyle = chart.StyleShow()
+	// Room for the title above the chart.
+	graph.Background.Padding = chart.Box{Top: 50}
+}
+
+func PercentValueFormatter(v interface{}) string {
+	return fmt.Sprintf("%.0f%%", v.(float64))
+}
+
+// concurrencyLookback is how long before a period builds are fetched to
+// include their jobs still running during it. Builds are selected by when
+// they were created, and their jobs can run long after that.
+const concurrencyLookback = 6 * time.Hour
+
+// queueTimelines collects the jobs of all builds, regardless of report, per
+// agent queue. The timelines include jobs outside of p, which callers clip.
+func (wr *Routes) queueTimelines(r *http.Request, p timePeriod) (map[queueKey]*queueTimeline, Coverage, error) {
+	timelines := make(map[queueKey]*queueTimeline)
+	allBuilds := BuildPredicateFunc(func(Build) bool { return true })
+	coverage, err := wr.Buildkite.ForEachBuild(r.Context(), p.From.Add(-concurrencyLookback), p.To, allBuilds, func(b Build) error {
+		for _, j := range b.Jobs {
+			q := queueKey{b.Org, j.Queue}
+			t, ok := timelines[q]
+			if !ok {
+				t = &queueTimeline{Org: b.Org, Queue: j.Queue}
+				timelines[q] = t
+			}
+			t.add(j)
+		}
+		return nil
+	})
+	return timelines, coverage, err
+}
+
+func (wr *Routes) agents(w http.ResponseWriter, r *http.Request) {
+	period, err := wr.period(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timelines, coverage, err := wr.queueTimelines(r, period.timePeriod)
+	if respondFetchError(w, coverage, err) {
+		return
+	}
+
+	utilizations := make([]queueUtilization, 0, len(timelines))
+	for _, t := range timelines {
+		// Queues only seen during the lookback had no jobs running during
+		// the period.
+		if u := t.Utilization(period.From, period.To); u.Jobs > 0 {
+			utilizations = append(utilizations, u)
+		}
+	}
+	sort.Slice(utilizations, func(i, j int) bool {
+		if utilizations[i].Org != utilizations[j].Org {
+			return utilizations[i].Org < utilizations[j].Org
+		}
+		return utilizations[i].Queue < utilizations[j].Queue
+	})
+
+	wr.printReportTopHtml(w, r, period, coverage)
+	fmt.Fprintf(w, `<h1>Agent utilization</h1><p><a href="/">Back to dashboard</a></p>`)
+	fmt.Fprintf(w, `<h2>Agent queues %s</h2><p>A queue is saturated when all agents that ran a job on it during the same hour were busy.</p>`, period.Description)
+	fmt.Fprintf(w, `<table class="table table-condensed"><tr><th>Organization</th><th>Queue</th><th>Jobs</th><th>Agents</th><th>Peak concurrency</th><th>Idle</th><th>Longest idle gap</th><th>Saturated</th></tr>`)
+	for _, u := range utilizations {
+		fmt.Fprintf(w, `<tr><td>%s</td><th>%s</th><td>%d</td><td>%d</td><td>%d (%s)</td><td>%s</td><td>%s (%s)</td><td>%s</td></tr>`,
+			html.EscapeString(u.Org), html.EscapeString(u.Queue), u.Jobs, u.Agents, u.Peak, u.PeakAt.Format(time.RFC822),
+			u.Idle.Truncate(time.Second), u.LongestIdle.Duration().Truncate(time.Second), u.LongestIdle.From.Format(time.RFC822),
+			u.Saturated.Truncate(time.Second))
+	}
+	fmt.Fprintf(w, `</table>`)
+
+	for _, u := range utilizations {
+		fmt.Fprintf(w, `<h3>%s/%s</h3><img src="/agents/%s/%s/concurrency%s" />`, html.EscapeString(u.Org), html.EscapeString(u.Queue), pathSegment(u.Org), pathSegment(u.Queue), period.LinkQuery())
+		if len(u.SaturationPeriods) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, `<p>Longest saturation periods:</p><ul>`)
+		for _, p := range u.SaturationPeriods {
+			fmt.Fprintf(w, `<li>%s for %s</li>`, p.From.Format(time.RFC822), p.Duration().Truncate(time.Second))
+		}
+		fmt.Fprintf(w, `</ul>`)
+	}
+	wr.printBottomHtml(w, r)
+}
+
+func (wr *Routes) concurrencyChart(w http.ResponseWriter, r *http.Request) {
+	queue := queueKey{urlParam(r, "org"), urlParam(r, "queue")}
+
+	period, err := wr.period(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timelines, coverage, err := wr.queueTimelines(r, period.timePeriod)
+	if respondFetchError(w, coverage, err) {
+		return
+	}
+	timeline, ok := timelines[queue]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	ts := chart.TimeSeries{
+		Name: "Running jobs",
+		Style: chart.Style{
+			DotWidth: -1, // Don't show dots
+			Show:     true,
+		},
+	}
+	previous := 0
+	for _, step := range timeline.StepsBetween(period.From, period.To) {
+		// Two points per step to get a step chart instead of slopes.
+		ts.XValues = append(ts.XValues, step.When, step.When)
+		ts.YValues = append(ts.YValues, float64(previous), float64(step.Running))
+		previous = step.Running
+	}
+
+	graph := chart.Chart{
+		XAxis: chart.XAxis{
+			Style: chart.StyleShow(),
+		},
+		Series: []chart.Series{ts},
+		Height: 350,
+		Width:  980,
+		YAxis: chart.YAxis{
+			Name:      "Running jobs",
+			NameStyle: chart.StyleShow(),
+			Style:     chart.StyleShow(),
+			Range: &chart.ContinuousRange{
+				Min: 0,
+				Max: max(ts.YValues),
+			},
+		},
+	}
+
+	markIncomplete(&graph, coverage)
+
 	w.Header().Set("Content-Type", "image/png")
 	if err := graph.Render(chart.PNG, w); err != nil {
 		log.Println(err)
@@ -333,8 +852,6 @@ func allBuildsTs(items []timelineDuration) chart.TimeSeries {
 }
 
 func rollingAverageTs(items []timelineDuration) chart.TimeSeries {
-	rollingAverage := ring.New(15)
-
 	rollingAverageTS := chart.TimeSeries{
 		Style: chart.Style{
 			DotWidth: -1, // Don't show dots
@@ -342,26 +859,9 @@ func rollingAverageTs(items []timelineDuration) chart.TimeSeries {
 		},
 	}
 
-	for _, sample := range items {
-		// Save duration
-		rollingAverage.Value = sample.Duration.Seconds()
-
-		// Move ring to the next value
-		rollingAverage = rollingAverage.Next()
-
-		// Current average
-		var currentRollingSum float64
-		var currentRollingCount int
-
-		rollingAverage.Do(func(val interface{}) {
-			if val != nil {
-				currentRollingSum += val.(float64)
-				currentRollingCount++
-			}
-		})
-
+	for _, sample := range rollingAverage(items) {
 		rollingAverageTS.XValues = append(rollingAverageTS.XValues, sample.When)
-		rollingAverageTS.YValues = append(rollingAverageTS.YValues, currentRollingSum/float64(currentRollingCount))
+		rollingAverageTS.YValues = append(rollingAverageTS.YValues, sample.Duration.Seconds())
 	}
 
 	return rollingAverageTS
@@ -384,6 +884,30 @@ func nilToString(s *string) string {
 	return *s
 }
 
-func (wr *Routes) fromTime(w *http.Request) time.Time {
-	return time.Now().Add(-wr.ScrapeHistory)
+// urlParam is like chi.URLParam, but unescapes the value. Needed for groups
+// containing slashes.
+func urlParam(r *http.Request, key string) string {
+	value := chi.URLParam(r, key)
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		return unescaped
+	}
+	return value
+}
+
+// buildLink returns a link to a build showing its number and abbreviated
+// commit.
+func buildLink(b buildRef) string {
+	commit := b.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	if b.WebURL == "" {
+		return html.EscapeString(fmt.Sprintf("#%d %s", b.Number, commit))
+	}
+	return fmt.Sprintf(`<a href="%s">#%d</a> <code>%s</code>`, html.EscapeString(b.WebURL), b.Number, html.EscapeString(commit))
+}
+
+// pathSegment escapes s to be used as a path segment of a link.
+func pathSegment(s string) string {
+	return html.EscapeString(url.PathEscape(s))
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	chart "github.com/wcharczuk/go-chart"
+)
+
+func TestOutcomeTopListLinksFailureRateOfSeveralDays(t *testing.T) {
+	day := time.Date(2019, 3, 1, 10, 0, 0, 0, time.Local)
+	var oneDay, twoDays buildOutcomes
+	oneDay.Name = "one-day"
+	oneDay.add(Build{State: "failed", CreatedAt: day})
+	oneDay.add(Build{State: "passed", CreatedAt: day.Add(time.Hour)})
+	twoDays.Name = "two-days"
+	twoDays.add(Build{State: "failed", CreatedAt: day})
+	twoDays.add(Build{State: "passed", CreatedAt: day.Add(24 * time.Hour)})
+
+	var buf bytes.Buffer
+	outcomeTopList(&buf, Query{ID: "report"}, reportPeriod{}, buildOutcomesSlice{oneDay, twoDays})
+
+	if strings.Contains(buf.String(), "/report/failure-rate/one-day") {
+		t.Error("linked the failure rate chart of a group with builds on a single day")
+	}
+	if !strings.Contains(buf.String(), "/report/failure-rate/two-days") {
+		t.Error("did not link the failure rate chart of a group with builds on two days")
+	}
+}
+
+func TestIncompleteDataIsShown(t *testing.T) {
+	start := time.Date(2019, 3, 1, 0, 0, 0, 0, time.Local)
+	intervals := generateIntervals(start, start.Add(3*time.Hour), time.Hour)
+	c := newCoverage("org", intervals)
+	c.Failed = []FailedInterval{{intervals[1], "org", errors.New("boom")}}
+
+	var page bytes.Buffer
+	printCoverageWarning(&page, c)
+	if want := intervals[1].From.Format(time.RFC822); !strings.Contains(page.String(), want) {
+		t.Errorf("warning %q does not mention the missing hour %s", page.String(), want)
+	}
+
+	graph := chart.Chart{
+		Series: []chart.Series{chart.TimeSeries{
+			XValues: []time.Time{intervals[0].From, intervals[2].From},
+			YValues: []float64{1, 2},
+		}},
+	}
+	markIncomplete(&graph, c)
+	if !strings.Contains(graph.Title, "1 out of 3") {
+		t.Errorf("title = %q, want it to count the missing intervals", graph.Title)
+	}
+	var png bytes.Buffer
+	if err := graph.Render(chart.PNG, &png); err != nil {
+		t.Fatal(err)
+	}
+}